@@ -0,0 +1,529 @@
+package main
+
+import (
+	"clickhouse-migrations/config"
+	"clickhouse-migrations/database"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errUsage = errors.New("invalid usage")
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(ctx context.Context, args []string) error
+	// state opens the checkpoint and dead letter stores of a command
+	// writing them, creating their tables; other commands leave them be
+	state bool
+	// ledger records the runs of a command writing batches in the ledger,
+	// creating its tables; other commands only read them
+	ledger bool
+}
+
+var commands = []*command{
+	{
+		name:   "migrate",
+		usage:  "migrate <table>|all",
+		help:   "Copy tables from Postgres to ClickHouse",
+		run:    runMigrate,
+		state:  true,
+		ledger: true,
+	},
+	{
+		name:   "repair",
+		usage:  "repair <table> <from> <to>",
+		help:   "Insert rows keyed in [from, to) that are missing in ClickHouse",
+		run:    runRepair,
+		state:  true,
+		ledger: true,
+	},
+	{
+		name:   "replay",
+		usage:  "replay <table>|all",
+		help:   "Insert dead lettered rows again after a fix",
+		run:    runReplay,
+		state:  true,
+		ledger: true,
+	},
+	{
+		name:  "status",
+		usage: "status",
+		help:  "Show source and destination row counts",
+		run:   runStatus,
+	},
+	{
+		name:  "sync",
+		usage: "sync",
+		help:  "Apply Postgres changes to ClickHouse continuously",
+		run:   runSync,
+		state: true,
+	},
+	{
+		name:   "incremental",
+		usage:  "incremental <table>|all",
+		help:   "Copy rows changed since the last run, on a schedule",
+		run:    runIncremental,
+		state:  true,
+		ledger: true,
+	},
+	{
+		name:  "schema",
+		usage: "schema <subcommand> [args]",
+		help: "Manage ClickHouse DDL: plan|apply [table...] the destination tables, " +
+			"up|down|redo|status or to <version> the versioned migrations",
+		run: runSchema,
+	},
+	{
+		name:  "verify",
+		usage: "verify",
+		help:  "Compare per day and workspace counts and hashes",
+		run:   runVerify,
+	},
+	{
+		name:  "bench",
+		usage: "bench jobs|audits [rows]",
+		help:  "Compare GORM and native insert throughput on synthetic rows in the bench.database scratch database",
+		run:   runBench,
+	},
+	{
+		name:  "history",
+		usage: "history [run_id]",
+		help:  "List recent runs from the ledger, or the batches of one",
+		run:   runHistory,
+	},
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", c.usage, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nTables: %s\n", strings.Join(migrationNames(), ", "))
+	fmt.Fprintf(os.Stderr, "\nRun with -h to list flags.\n")
+}
+
+func migrationNames() []string {
+	var names []string
+	for _, m := range database.Migrators() {
+		names = append(names, m.Name())
+	}
+	return names
+}
+
+// selectMigrators resolves a table name or "all" to registered migrations.
+func selectMigrators(name string) ([]database.Migrator, error) {
+	if name == "all" {
+		return database.Migrators(), nil
+	}
+
+	m := database.Lookup(name)
+	if m == nil {
+		return nil, fmt.Errorf("unknown table %q, expected one of: %s, all", name, strings.Join(migrationNames(), ", "))
+	}
+	return []database.Migrator{m}, nil
+}
+
+func runMigrate(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	migrators, err := selectMigrators(args[0])
+	if err != nil {
+		return err
+	}
+
+	if config.Config.Migration.DryRun {
+		return runPlan(ctx, migrators)
+	}
+
+	for _, m := range migrators {
+		slog.Info("Migration started", "table", m.Name())
+		if err := m.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runPlan prints the dry run plans of migrators, failing if a sample row
+// would not convert or insert.
+func runPlan(ctx context.Context, migrators []database.Migrator) error {
+	var problems int
+	for _, m := range migrators {
+		p, err := m.Plan(ctx)
+		if err != nil {
+			return err
+		}
+		printPlan(p)
+		problems += len(p.Problems)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("Dry run found %d problems", problems)
+	}
+	return nil
+}
+
+func printPlan(p *database.Plan) {
+	estimated := "unknown"
+	if p.EstimatedRows >= 0 {
+		estimated = strconv.FormatInt(p.EstimatedRows, 10)
+	}
+
+	fmt.Printf("Table %s -> ClickHouse %s\n", p.Table, p.Destination)
+	fmt.Printf("  rows: %d (planner estimate %s), batches: %d\n", p.Rows, estimated, p.Batches)
+
+	fmt.Printf("  ranges:\n")
+	for _, r := range p.Ranges {
+		from, to := "-inf", "+inf"
+		if !r.From.IsZero() {
+			from = r.From.Format(time.RFC3339)
+		}
+		if !r.To.IsZero() {
+			to = r.To.Format(time.RFC3339)
+		}
+		done := ""
+		if r.Done {
+			done = " done"
+		}
+		fmt.Printf("    %-10s [%s, %s)%s\n", r.Name, from, to, done)
+	}
+
+	fmt.Printf("  first page plan:\n")
+	for _, line := range p.Explain {
+		fmt.Printf("    %s\n", line)
+	}
+
+	fmt.Printf("  sample: %d rows converted\n", p.Sampled)
+	for _, problem := range p.Problems {
+		fmt.Printf("  problem: %s\n", problem)
+	}
+	fmt.Println()
+}
+
+func runRepair(ctx context.Context, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+
+	m := database.Lookup(args[0])
+	if m == nil {
+		return fmt.Errorf("unknown table %q, expected one of: %s", args[0], strings.Join(migrationNames(), ", "))
+	}
+
+	from, err := database.ParseTime(args[1])
+	if err != nil {
+		return err
+	}
+	to, err := database.ParseTime(args[2])
+	if err != nil {
+		return err
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("empty range, %s is not before %s", args[1], args[2])
+	}
+
+	n, err := m.Repair(ctx, from, to)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Repair completed", "table", m.Name(), "rows", n)
+	return nil
+}
+
+func runReplay(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	migrators, err := selectMigrators(args[0])
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrators {
+		if _, err := m.Replay(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printStatus(statuses []*database.TableStatus) {
+	fmt.Printf("%-10s %15s %15s %15s\n", "TABLE", "POSTGRES", "CLICKHOUSE", "MISSING")
+	for _, s := range statuses {
+		fmt.Printf("%-10s %15d %15d %15d\n", s.Table, s.Source, s.Destination, s.Missing())
+	}
+}
+
+func runStatus(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	statuses, err := database.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	printStatus(statuses)
+	return nil
+}
+
+func runSync(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return database.Sync(ctx)
+}
+
+// runIncremental runs the increments of the selected tables every
+// incremental.interval seconds. A failed run is logged and retried from the
+// same watermark on the next tick; with an interval of 0 it is returned.
+func runIncremental(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	migrators, err := selectMigrators(args[0])
+	if err != nil {
+		return err
+	}
+
+	var (
+		cfg      = config.Config.Incremental
+		interval = time.Duration(cfg.Interval) * time.Second
+		overlap  = time.Duration(cfg.Overlap) * time.Second
+	)
+
+	for {
+		start := time.Now()
+		for _, m := range migrators {
+			if _, err := m.Increment(ctx, overlap); err != nil {
+				if interval == 0 || ctx.Err() != nil {
+					return err
+				}
+				slog.Error("Incremental run failed", "error", err)
+			}
+		}
+		if interval == 0 {
+			return nil
+		}
+
+		wait := time.Until(start.Add(interval))
+		slog.Info("Next incremental run", "in", wait.Round(time.Second))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	diffs, err := database.Verify(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(diffs) == 0 {
+		fmt.Println("All tables match")
+		return nil
+	}
+
+	fmt.Printf("%-10s %-10s %-36s %12s %12s %s\n", "TABLE", "DAY", "WORKSPACE", "POSTGRES", "CLICKHOUSE", "HASH")
+	for _, d := range diffs {
+		hash := "match"
+		if d.SourceHash != d.DestHash {
+			hash = "differs"
+		}
+		fmt.Printf("%-10s %-10s %-36s %12d %12d %s\n", d.Table, d.Day, d.WorkspaceID, d.SourceRows, d.DestRows, hash)
+	}
+	return fmt.Errorf("Verification failed: %d mismatched partitions", len(diffs))
+}
+
+// benchRows is how many synthetic rows bench inserts by default.
+const benchRows = 1_000_000
+
+func runBench(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	n := benchRows
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+			return fmt.Errorf("invalid row count %q", args[1])
+		}
+	}
+
+	results, err := database.Bench(ctx, args[0], n)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-10s %-8s %12s %12s %12s\n", "TABLE", "WRITER", "ROWS", "SECONDS", "ROWS/S")
+	for _, r := range results {
+		fmt.Printf("%-10s %-8s %12d %12.2f %12.0f\n", r.Table, r.Writer, r.Rows, r.Duration.Seconds(), r.RowsPerSecond())
+	}
+	return nil
+}
+
+// historyRuns is how many recent runs history lists.
+const historyRuns = 20
+
+func runHistory(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	if err := database.OpenLedger(ctx); err != nil {
+		return err
+	}
+
+	switch len(args) {
+	case 0:
+		runs, err := database.LedgerRuns(ctx, historyRuns)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-36s %-19s %-11s %12s  %s\n", "RUN", "STARTED", "STATUS", "ROWS", "COMMAND")
+		for _, r := range runs {
+			fmt.Printf("%-36s %-19s %-11s %12d  %s\n", r.RunID, r.StartedAt.Format(time.DateTime), r.Status, r.Rows, r.Command)
+		}
+		return nil
+
+	case 1:
+		summaries, err := database.LedgerBatches(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if len(summaries) == 0 {
+			return fmt.Errorf("no batches recorded for run %s", args[0])
+		}
+		fmt.Printf("%-10s %-8s %10s %12s %12s\n", "TABLE", "STATUS", "BATCHES", "ROWS", "WRITTEN")
+		for _, s := range summaries {
+			fmt.Printf("%-10s %-8s %10d %12d %12d\n", s.Table, s.Status, s.Batches, s.Rows, s.Written)
+		}
+		return nil
+	}
+	return errUsage
+}
+
+func selectSchemas(names []string) ([]*database.TableSchema, error) {
+	if len(names) == 0 {
+		return database.Schemas(), nil
+	}
+
+	var schemas []*database.TableSchema
+	for _, name := range names {
+		s := database.LookupSchema(name)
+		if s == nil {
+			return nil, fmt.Errorf("no schema for ClickHouse table %q", name)
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+func runSchema(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "plan":
+		return runSchemaPlan(args[1:], (*database.TableSchema).Plan)
+	case "apply":
+		return runSchemaPlan(args[1:], (*database.TableSchema).Apply)
+	case "status":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return runSchemaStatus()
+	case "to":
+		if len(args) != 2 {
+			return errUsage
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid schema version %q", args[1])
+		}
+		return database.SchemaTo(version)
+	}
+
+	run, ok := map[string]func() error{
+		"up":   database.SchemaUp,
+		"down": database.SchemaDown,
+		"redo": database.SchemaRedo,
+	}[args[0]]
+	if !ok || len(args) != 1 {
+		return errUsage
+	}
+	return run()
+}
+
+func runSchemaPlan(tables []string, plan func(s *database.TableSchema) ([]string, error)) error {
+	schemas, err := selectSchemas(tables)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range schemas {
+		stmts, err := plan(s)
+		if err != nil {
+			return err
+		}
+		if len(stmts) == 0 {
+			fmt.Printf("-- %s is up to date (version %d)\n", s.Name, s.Version)
+			continue
+		}
+		for _, stmt := range stmts {
+			fmt.Printf("%s;\n", stmt)
+		}
+	}
+
+	return nil
+}
+
+func runSchemaStatus() error {
+	statuses, err := database.SchemaStatus()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-15s %-40s %s\n", "VERSION", "NAME", "APPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%-15d %-40s %s\n", s.Version, s.Name, appliedAt)
+	}
+	return nil
+}
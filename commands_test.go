@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelectMigrators(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+		err   string
+	}{
+		{name: "all", names: []string{"jobs", "audits"}},
+		{name: "jobs", names: []string{"jobs"}},
+		{name: "robots", err: `unknown table "robots", expected one of: jobs, audits, all`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrators, err := selectMigrators(tt.name)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("selectMigrators() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, m := range migrators {
+				names = append(names, m.Name())
+			}
+			if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+				t.Errorf("selectMigrators() = %v, want %v", names, tt.names)
+			}
+		})
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	for _, c := range commands {
+		if findCommand(c.name) != c {
+			t.Errorf("findCommand(%q) does not return its command", c.name)
+		}
+	}
+	if findCommand("copy") != nil {
+		t.Error(`findCommand("copy") found a command`)
+	}
+}
+
+func TestCommandStores(t *testing.T) {
+	for _, c := range commands {
+		// commands recording batches in the ledger write state as well
+		if c.ledger && !c.state {
+			t.Errorf("%s records runs in the ledger without opening its stores", c.name)
+		}
+	}
+	// read only commands must not create any table
+	for _, name := range []string{"status", "schema", "verify", "bench", "history"} {
+		if c := findCommand(name); c.state || c.ledger {
+			t.Errorf("%s creates the checkpoint, dead letter or ledger tables", name)
+		}
+	}
+}
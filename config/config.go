@@ -1,8 +1,25 @@
 package config
 
 type config struct {
-	ClickHouse Database
-	Database   Database
+	ClickHouse  Database
+	Database    Database
+	Checkpoint  Checkpoint
+	Schema      Schema
+	Migration   Migration
+	Insert      Insert
+	Sync        Sync
+	Incremental Incremental
+	Retry       Retry
+	DeadLetter  DeadLetter
+	Ledger      Ledger
+	Metrics     Metrics
+	Bench       Bench
+	Progress    Progress
+	Log         Log
+	Trace       Trace
+
+	// Command holds the positional arguments, e.g. ["migrate", "jobs"].
+	Command []string
 }
 
 type Database struct {
@@ -17,3 +34,112 @@ type Database struct {
 	ConnMaxLifetime int
 	Debug           bool
 }
+
+type Checkpoint struct {
+	Store string
+	Path  string
+	Table string
+}
+
+type Schema struct {
+	Dir   string
+	Table string
+}
+
+// Migration tunes migrate. Since and Until are a date or RFC 3339 time,
+// empty leaving that side of the key range open; no Workspaces means every
+// workspace.
+type Migration struct {
+	Resume     bool
+	DryRun     bool
+	Sample     int
+	PageSize   int
+	BatchSize  int
+	Workers    int
+	Partition  string
+	Mappings   []string
+	Since      string
+	Until      string
+	Workspaces []string
+}
+
+// Insert selects how batches are written to ClickHouse: Writer is gorm or
+// native, the latter sending columns of BlockSize rows over the native
+// protocol with Compression lz4, zstd or none. Deduplicate sends every
+// batch with a deterministic insert_deduplication_token. The token depends
+// on the batch boundaries, so it only keeps a resume from duplicating rows
+// with the batch and page size of the run it resumes.
+type Insert struct {
+	Writer      string
+	BlockSize   int
+	Compression string
+	Deduplicate bool
+}
+
+type Sync struct {
+	Slot           string
+	Publication    string
+	StatusInterval int
+}
+
+type Incremental struct {
+	Interval int
+	Overlap  int
+}
+
+// Retry is the policy for connecting, source reads and ClickHouse inserts.
+// Initial and Max are milliseconds, Elapsed is seconds; a zero Attempts or
+// Elapsed does not limit retries.
+type Retry struct {
+	Attempts int
+	Initial  int
+	Max      int
+	Elapsed  int
+}
+
+type DeadLetter struct {
+	Sink  string
+	Path  string
+	Table string
+}
+
+// Ledger names the ClickHouse tables recording every run of a writing
+// command and every batch it wrote.
+type Ledger struct {
+	Enabled bool
+	Runs    string
+	Batches string
+}
+
+type Metrics struct {
+	Addr string
+}
+
+// Bench names the scratch ClickHouse database bench copies destination
+// tables into and drops them from. Bench does not run without one.
+type Bench struct {
+	Database string
+}
+
+type Progress struct {
+	Interval int
+	Count    string
+	Report   string
+}
+
+// Log configures the slog logger: Format is text or json, Level one of
+// debug, info, warn or error, and Output stderr, stdout or a file path.
+type Log struct {
+	Format string
+	Level  string
+	Output string
+}
+
+// Trace configures OpenTelemetry spans: Exporter is none, otlp, sending to
+// the OTLP/HTTP collector at Endpoint, or file, writing JSON spans to Path.
+type Trace struct {
+	Exporter string
+	Endpoint string
+	Insecure bool
+	Path     string
+}
@@ -110,4 +110,77 @@ var Default = &config{
 		ConnMaxLifetime: getMaxLifetime(),
 		Debug:           false,
 	},
+	Checkpoint: Checkpoint{
+		Store: "file",
+		Path:  "checkpoints.json",
+		Table: "migration_checkpoints",
+	},
+	Schema: Schema{
+		Dir:   "",
+		Table: "schema_migrations",
+	},
+	Migration: Migration{
+		Resume:    false,
+		DryRun:    false,
+		Sample:    1_000,
+		Since:     "",
+		Until:     "",
+		PageSize:  1_000_000,
+		BatchSize: 100_000,
+		Workers:   4,
+		Partition: "month",
+	},
+	Insert: Insert{
+		Writer:      "gorm",
+		BlockSize:   100_000,
+		Compression: "lz4",
+		Deduplicate: true,
+	},
+	Sync: Sync{
+		Slot:           "clickhouse_migrations",
+		Publication:    "clickhouse_migrations",
+		StatusInterval: 10,
+	},
+	Incremental: Incremental{
+		Interval: 300,
+		Overlap:  600,
+	},
+	Retry: Retry{
+		Attempts: 10,
+		Initial:  500,
+		Max:      30_000,
+		Elapsed:  600,
+	},
+	DeadLetter: DeadLetter{
+		Sink:  "file",
+		Path:  "dead_letters.ndjson",
+		Table: "migration_dead_letters",
+	},
+	Ledger: Ledger{
+		Enabled: true,
+		Runs:    "migration_runs",
+		Batches: "migration_batches",
+	},
+	Metrics: Metrics{
+		Addr: "",
+	},
+	Bench: Bench{
+		Database: "",
+	},
+	Progress: Progress{
+		Interval: 30,
+		Count:    "estimate",
+		Report:   "",
+	},
+	Log: Log{
+		Format: "text",
+		Level:  "info",
+		Output: "stderr",
+	},
+	Trace: Trace{
+		Exporter: "none",
+		Endpoint: "",
+		Insecure: false,
+		Path:     "traces.json",
+	},
 }
@@ -105,32 +105,46 @@ func (v *kvSliceValue) String() string {
 }
 
 // -- stringSliceValue
-type stringSliceValue []string
+// The first Set replaces the default; repeating the flag appends, so
+// -f a -f b,c yields [a b c].
+type stringSliceValue struct {
+	p   *[]string
+	set bool
+}
 
 func newStringSliceValue(val []string, p *[]string) *stringSliceValue {
 	*p = val
-	return (*stringSliceValue)(p)
+	return &stringSliceValue{p: p}
 }
 
 func (v *stringSliceValue) Set(s string) error {
-	*v = []string{}
+	if !v.set {
+		*v.p = []string{}
+		v.set = true
+	}
 	for _, x := range strings.Split(s, ",") {
 		x = strings.TrimSpace(x)
 		if x == "" {
 			continue
 		}
-		*v = append(*v, x)
+		*v.p = append(*v.p, x)
 	}
 	return nil
 }
 
-func (v *stringSliceValue) Get() interface{} { return []string(*v) }
-func (v *stringSliceValue) String() string   { return strings.Join(*v, ",") }
+func (v *stringSliceValue) Get() interface{} { return *v.p }
+func (v *stringSliceValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
 
 // -- FlagSet
 type FlagSet struct {
 	flag.FlagSet
-	set map[string]bool
+	set  map[string]bool
+	args []string
 }
 
 func NewFlagSet(name string, errorHandling flag.ErrorHandling) *FlagSet {
@@ -156,12 +170,39 @@ func (f *FlagSet) StringSliceVar(p *[]string, name string, value []string, usage
 	f.Var(newStringSliceValue(value, p), name, usage)
 }
 
+// Args returns the non-flag arguments in the order they were given.
+func (f *FlagSet) Args() []string {
+	return f.args
+}
+
+// parseInterleaved parses args like Parse but keeps going after the first
+// non-flag argument, so flags may appear before or after subcommands. The
+// arguments after a "--" terminator are all kept as non-flag arguments.
+func (f *FlagSet) parseInterleaved(args []string) error {
+	f.args = nil
+	for {
+		if err := f.Parse(args); err != nil {
+			return err
+		}
+		rest := f.FlagSet.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			f.args = append(f.args, rest...)
+			return nil
+		}
+		if len(rest) == 0 {
+			return nil
+		}
+		f.args = append(f.args, rest[0])
+		args = rest[1:]
+	}
+}
+
 // ParseFlags parses command line arguments and provides fallback
 // values from environment variables and config file values.
 // Environment variables are case-insensitive and can have either
 // of the provided prefixes.
 func (f *FlagSet) ParseFlags(args, environ, prefixes []string, p *properties.Properties) error {
-	if err := f.Parse(args); err != nil {
+	if err := f.parseInterleaved(args); err != nil {
 		return err
 	}
 
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestParseInterleaved(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		rest    []string
+		workers int
+		dryRun  bool
+	}{
+		{name: "flags first", args: []string{"-workers", "4", "migrate", "jobs"}, rest: []string{"migrate", "jobs"}, workers: 4},
+		{name: "flags after subcommand", args: []string{"migrate", "-workers", "4", "jobs", "-dry-run"},
+			rest: []string{"migrate", "jobs"}, workers: 4, dryRun: true},
+		{name: "terminator", args: []string{"migrate", "-workers", "4", "--", "-dry-run", "jobs"},
+			rest: []string{"migrate", "-dry-run", "jobs"}, workers: 4},
+		{name: "terminator first", args: []string{"--", "-workers", "4"}, rest: []string{"-workers", "4"}, workers: 1},
+		{name: "no arguments", workers: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				f       = NewFlagSet("test", flag.ContinueOnError)
+				workers int
+				dryRun  bool
+			)
+			f.IntVar(&workers, "workers", 1, "")
+			f.BoolVar(&dryRun, "dry-run", false, "")
+
+			if err := f.parseInterleaved(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(f.Args(), tt.rest) {
+				t.Errorf("Args() = %q, want %q", f.Args(), tt.rest)
+			}
+			if workers != tt.workers || dryRun != tt.dryRun {
+				t.Errorf("workers, dry-run = %d, %v, want %d, %v", workers, dryRun, tt.workers, tt.dryRun)
+			}
+		})
+	}
+}
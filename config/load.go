@@ -3,6 +3,7 @@ package config
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"strings"
 
@@ -94,7 +95,7 @@ func load(p *properties.Properties) (cfg *config, err error) {
 	f.StringVar(&cfg.Database.User, "postgres.user", Default.Database.User, "Database username")
 	f.StringVar(&cfg.Database.Password, "postgres.password", Default.Database.Password, "Database password")
 	f.StringVar(&cfg.Database.Name, "postgres.db", Default.Database.Name, "Database name")
-	f.BoolVar(&cfg.Database.Debug, "postgres.debug", Default.Database.Debug, "Database debug verbose mode")
+	f.BoolVar(&cfg.Database.Debug, "postgres.debug", Default.Database.Debug, "Log every postgres query at debug level")
 	f.IntVar(&cfg.Database.ConnMaxIdle, "postgres.connmaxidle", Default.Database.ConnMaxIdle, "Maximum number of connections in the idle connection pool")
 	f.IntVar(&cfg.Database.ConnMaxOpen, "postgres.connmaxopen", Default.Database.ConnMaxOpen, "Maximum number of open connections to the database")
 	f.IntVar(&cfg.Database.ConnMaxLifetime, "postgres.connmaxlifetime", Default.Database.ConnMaxLifetime, "Maximum amount of time a connection may be reused")
@@ -106,6 +107,81 @@ func load(p *properties.Properties) (cfg *config, err error) {
 	f.StringVar(&cfg.ClickHouse.Password, "clickhouse.password", Default.ClickHouse.Password, "Database password")
 	f.StringVar(&cfg.ClickHouse.Name, "clickhouse.name", Default.ClickHouse.Name, "Database name")
 
+	// Checkpoint params
+	f.StringVar(&cfg.Checkpoint.Store, "checkpoint.store", Default.Checkpoint.Store, "Where to persist migration checkpoints: file, postgres or clickhouse")
+	f.StringVar(&cfg.Checkpoint.Path, "checkpoint.path", Default.Checkpoint.Path, "Checkpoint file path when checkpoint.store is file")
+	f.StringVar(&cfg.Checkpoint.Table, "checkpoint.table", Default.Checkpoint.Table, "Checkpoint table name when checkpoint.store is postgres or clickhouse")
+
+	// Schema params
+	f.StringVar(&cfg.Schema.Dir, "schema.dir", Default.Schema.Dir, "Directory of versioned .sql schema migrations, the embedded ones when empty")
+	f.StringVar(&cfg.Schema.Table, "schema.table", Default.Schema.Table, "ClickHouse table recording applied schema migrations")
+
+	// Migration params
+	f.BoolVar(&cfg.Migration.Resume, "resume", Default.Migration.Resume, "Continue each migration from its last committed checkpoint")
+	f.BoolVar(&cfg.Migration.DryRun, "dry-run", Default.Migration.DryRun, "Plan migrate without writing: explain and count the source, convert and check a sample of rows")
+	f.IntVar(&cfg.Migration.Sample, "migration.sample", Default.Migration.Sample, "Rows converted and checked against the destination columns by a dry run")
+	f.StringVar(&cfg.Migration.Since, "since", Default.Migration.Since, "Only migrate rows keyed at or after this date or RFC 3339 time")
+	f.StringVar(&cfg.Migration.Until, "until", Default.Migration.Until, "Only migrate rows keyed before this date or RFC 3339 time")
+	f.StringSliceVar(&cfg.Migration.Workspaces, "workspace", Default.Migration.Workspaces, "Only migrate rows of these workspace ids; repeat or separate with commas")
+	f.IntVar(&cfg.Migration.PageSize, "migration.pagesize", Default.Migration.PageSize, "Rows selected from Postgres per keyset page")
+	f.IntVar(&cfg.Migration.BatchSize, "migration.batchsize", Default.Migration.BatchSize, "Rows inserted into ClickHouse per batch")
+	f.IntVar(&cfg.Migration.Workers, "migration.workers", Default.Migration.Workers, "Number of key ranges migrated concurrently")
+	f.StringVar(&cfg.Migration.Partition, "migration.partition", Default.Migration.Partition, "How source tables are split into ranges: month, day or none")
+	f.StringSliceVar(&cfg.Migration.Mappings, "migration.mappings", Default.Migration.Mappings, "Comma separated YAML or JSON table mapping files")
+
+	// Insert params
+	f.StringVar(&cfg.Insert.Writer, "insert.writer", Default.Insert.Writer, "How batches are inserted into ClickHouse: gorm or native columnar blocks")
+	f.IntVar(&cfg.Insert.BlockSize, "insert.blocksize", Default.Insert.BlockSize, "Rows per block sent by the native writer")
+	f.StringVar(&cfg.Insert.Compression, "insert.compression", Default.Insert.Compression, "Native protocol compression: lz4, zstd or none")
+	f.BoolVar(&cfg.Insert.Deduplicate, "insert.deduplicate", Default.Insert.Deduplicate, "Send a deduplication token derived from table, key range and run with every batch, so retried inserts and resumes with the same batch and page size are not duplicated")
+
+	// Sync params
+	f.StringVar(&cfg.Sync.Slot, "sync.slot", Default.Sync.Slot, "Postgres logical replication slot consumed by sync")
+	f.StringVar(&cfg.Sync.Publication, "sync.publication", Default.Sync.Publication, "Postgres publication of the tables replicated by sync")
+	f.IntVar(&cfg.Sync.StatusInterval, "sync.statusinterval", Default.Sync.StatusInterval, "Seconds between standby status updates sent by sync")
+
+	// Incremental params
+	f.IntVar(&cfg.Incremental.Interval, "incremental.interval", Default.Incremental.Interval, "Seconds between incremental runs, 0 to run once")
+	f.IntVar(&cfg.Incremental.Overlap, "incremental.overlap", Default.Incremental.Overlap, "Seconds before the watermark incremental runs read again to catch late commits")
+
+	// Retry params
+	f.IntVar(&cfg.Retry.Attempts, "retry.attempts", Default.Retry.Attempts, "Maximum attempts of a failing connection, read or insert, 0 for no limit")
+	f.IntVar(&cfg.Retry.Initial, "retry.initial", Default.Retry.Initial, "Milliseconds before the first retry, doubled on every further retry")
+	f.IntVar(&cfg.Retry.Max, "retry.max", Default.Retry.Max, "Maximum milliseconds between retries")
+	f.IntVar(&cfg.Retry.Elapsed, "retry.elapsed", Default.Retry.Elapsed, "Seconds after which a failing operation is no longer retried, 0 for no limit")
+
+	// Dead letter params
+	f.StringVar(&cfg.DeadLetter.Sink, "deadletter.sink", Default.DeadLetter.Sink, "Where rows failing conversion or insert go: file, clickhouse, or none to fail the migration")
+	f.StringVar(&cfg.DeadLetter.Path, "deadletter.path", Default.DeadLetter.Path, "NDJSON file of dead letters when deadletter.sink is file")
+	f.StringVar(&cfg.DeadLetter.Table, "deadletter.table", Default.DeadLetter.Table, "ClickHouse table of dead letters when deadletter.sink is clickhouse")
+
+	// Ledger params
+	f.BoolVar(&cfg.Ledger.Enabled, "ledger.enabled", Default.Ledger.Enabled, "Record runs and every batch they write in ClickHouse ledger tables")
+	f.StringVar(&cfg.Ledger.Runs, "ledger.runs", Default.Ledger.Runs, "ClickHouse table of runs with their command, status and row count")
+	f.StringVar(&cfg.Ledger.Batches, "ledger.batches", Default.Ledger.Batches, "ClickHouse table of batches with their key range, row count, content hash and status")
+
+	// Metrics params
+	f.StringVar(&cfg.Metrics.Addr, "metrics.addr", Default.Metrics.Addr, "Address serving Prometheus metrics at /metrics, e.g. :9090; disabled when empty")
+
+	// Bench params
+	f.StringVar(&cfg.Bench.Database, "bench.database", Default.Bench.Database, "Scratch ClickHouse database bench creates and drops its tables in, other than clickhouse.name; bench refuses to run when empty")
+
+	// Progress params
+	f.IntVar(&cfg.Progress.Interval, "progress.interval", Default.Progress.Interval, "Seconds between progress logs with percent complete and ETA, 0 to disable")
+	f.StringVar(&cfg.Progress.Count, "progress.count", Default.Progress.Count, "How source rows are counted for progress: estimate from pg_class or exact")
+	f.StringVar(&cfg.Progress.Report, "progress.report", Default.Progress.Report, "Path the JSON run report is written to at exit, - for stdout; disabled when empty")
+
+	// Log params
+	f.StringVar(&cfg.Log.Format, "log.format", Default.Log.Format, "Log format: text or json")
+	f.StringVar(&cfg.Log.Level, "log.level", Default.Log.Level, "Minimum log level: debug, info, warn or error")
+	f.StringVar(&cfg.Log.Output, "log.output", Default.Log.Output, "Log destination: stderr, stdout or a file path")
+
+	// Trace params
+	f.StringVar(&cfg.Trace.Exporter, "trace.exporter", Default.Trace.Exporter, "Span exporter: none, otlp or file")
+	f.StringVar(&cfg.Trace.Endpoint, "trace.endpoint", Default.Trace.Endpoint, "OTLP/HTTP collector host:port, OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318 when empty")
+	f.BoolVar(&cfg.Trace.Insecure, "trace.insecure", Default.Trace.Insecure, "Send OTLP spans over plain HTTP")
+	f.StringVar(&cfg.Trace.Path, "trace.path", Default.Trace.Path, "File JSON spans are appended to with the file exporter")
+
 	// filter out -test flags
 	var args []string
 	for _, a := range os.Args[1:] {
@@ -120,6 +196,27 @@ func load(p *properties.Properties) (cfg *config, err error) {
 	if err := f.ParseFlags(args, os.Environ(), prefixes, p); err != nil {
 		return nil, err
 	}
+	cfg.Command = f.Args()
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
+
+// validate rejects sizes the migration loops cannot make progress with:
+// batches and pages are cut in loops stepping by their size, and ranges
+// are queued to the workers one at a time.
+func (c *config) validate() error {
+	if c.Migration.BatchSize <= 0 {
+		return fmt.Errorf("Invalid migration batch size %d", c.Migration.BatchSize)
+	}
+	if c.Migration.PageSize <= 0 {
+		return fmt.Errorf("Invalid migration page size %d", c.Migration.PageSize)
+	}
+	if c.Migration.Workers <= 0 {
+		return fmt.Errorf("Invalid migration workers %d", c.Migration.Workers)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *config)
+		err    string
+	}{
+		{name: "defaults", modify: func(c *config) {}},
+		{name: "zero batch size", modify: func(c *config) { c.Migration.BatchSize = 0 }, err: "batch size 0"},
+		{name: "negative page size", modify: func(c *config) { c.Migration.PageSize = -1 }, err: "page size -1"},
+		{name: "no workers", modify: func(c *config) { c.Migration.Workers = 0 }, err: "workers 0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *Default
+			tt.modify(&c)
+			err := c.validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("validate() = %v, want nil", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("validate() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
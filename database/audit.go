@@ -1,7 +1,10 @@
 package database
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -42,58 +45,136 @@ type AuditPG struct {
 	NextState     []byte    `db:"next_state" json:"next_state"`
 }
 
-func MigrateAudits() {
-	var (
-		size = 1_000_000
-		page = 1
-	)
-
-	for {
-		var (
-			audits   []*AuditPG
-			chAudits = []*Audit{}
-		)
-
-		query := `select a.*, u.full_name from workspace.audit a
+const auditsQuery = `select a.id, a.user_id, u.full_name, a.workspace_id, a.category, a.action, a.description,
+			a.data, a.done_at, a.previous_state, a.next_state from workspace.audit a
 			inner join workspace.users u on a.user_id = u.id 
-			offset $1 rows fetch next $2 rows only`
+			where %s order by a.done_at, a.id limit %d`
 
-		if _, err := db.Select(&audits, query, (page-1)*size, size); err != nil {
-			log.Println("Migrate audits failed:", err)
-			return
-		}
+// scanAuditPG scans a row selected by auditsQuery.
+func scanAuditPG(rows *sql.Rows) (*AuditPG, error) {
+	a := &AuditPG{}
+	err := rows.Scan(&a.ID, &a.UserID, &a.Username, &a.WorkspaceID, &a.Category, &a.Action, &a.Description,
+		&a.Data, &a.DoneAt, &a.PreviousState, &a.NextState)
+	return a, err
+}
 
-		log.Println("Selected from pg")
+func (a *AuditPG) Audit() *Audit {
+	return &Audit{
+		ID:            a.ID,
+		WorkspaceID:   a.WorkspaceID,
+		UserID:        a.UserID,
+		Category:      a.Category,
+		Action:        a.Action,
+		Description:   a.Description,
+		Data:          a.Data,
+		PreviousState: a.PreviousState,
+		NextState:     a.NextState,
+		CreatedAt:     a.DoneAt.ValueOrZero(),
+	}
+}
 
-		for _, a := range audits {
-			chAudits = append(chAudits, &Audit{
-				ID:            a.ID,
-				WorkspaceID:   a.WorkspaceID,
-				UserID:        a.UserID,
-				Category:      a.Category,
-				Action:        a.Action,
-				Description:   a.Description,
-				Data:          a.Data,
-				PreviousState: a.PreviousState,
-				NextState:     a.NextState,
-				CreatedAt:     a.DoneAt.ValueOrZero(),
-			})
-		}
+var AuditsSchema = &TableSchema{
+	Name:    "audits",
+	Version: 2,
+	Columns: []*ColumnSchema{
+		{Name: "id", Type: "String"},
+		{Name: "workspace_id", Type: "String"},
+		{Name: "user_id", Type: "String"},
+		{Name: "category", Type: "LowCardinality(String)"},
+		{Name: "action", Type: "LowCardinality(String)"},
+		{Name: "description", Type: "String"},
+		{Name: "data", Type: "String", Codec: "ZSTD(3)"},
+		{Name: "previous_state", Type: "String", Codec: "ZSTD(3)"},
+		{Name: "next_state", Type: "String", Codec: "ZSTD(3)"},
+		{Name: "created_at", Type: "DateTime64(3)", Codec: "Delta(8), ZSTD(1)"},
+	},
+	// audits are immutable; the engine only collapses rows sent twice
+	Engine:      "ReplacingMergeTree",
+	PartitionBy: "toYYYYMM(created_at)",
+	OrderBy:     "(workspace_id, id)",
+	Settings:    dedupWindow,
+}
 
-		if len(chAudits) == 0 {
-			log.Println("Migration completed")
-			return
-		}
+var auditColumns = []string{"id", "workspace_id", "user_id", "category", "action", "description",
+	"data", "previous_state", "next_state", "created_at"}
+
+// auditValues returns the auditColumns of audits for the native writer.
+func auditValues(audits []*Audit) []interface{} {
+	var (
+		n             = len(audits)
+		id            = make([]string, n)
+		workspaceID   = make([]string, n)
+		userID        = make([]string, n)
+		category      = make([]string, n)
+		action        = make([]string, n)
+		description   = make([]string, n)
+		data          = make([]string, n)
+		previousState = make([]string, n)
+		nextState     = make([]string, n)
+		createdAt     = make([]time.Time, n)
+	)
+	for i, a := range audits {
+		id[i], workspaceID[i], userID[i] = a.ID, a.WorkspaceID, a.UserID
+		category[i], action[i], description[i] = a.Category, a.Action, a.Description
+		data[i], previousState[i], nextState[i] = string(a.Data), string(a.PreviousState), string(a.NextState)
+		createdAt[i] = a.CreatedAt
+	}
+	return []interface{}{id, workspaceID, userID, category, action, description,
+		data, previousState, nextState, createdAt}
+}
 
-		log.Println("Data convertion done")
+// auditsVerification reads workspace.audit without the users join of
+// auditsQuery, so audits dropped by it show up as missing. Audits without
+// done_at are not partitioned and left out on both sides.
+var auditsVerification = &Verification{
+	Source: `select floor(extract(epoch from a.done_at) / 86400)::bigint as day, a.workspace_id::text, count(*) as row_count,
+		` + pgHash(`a.id::text || '|' || a.user_id::text || '|' || coalesce(a.category, '') || '|' || coalesce(a.action, '') || '|' ||
+			floor(extract(epoch from a.done_at))::bigint`) + ` as hash
+		from workspace.audit a where a.done_at is not null%s group by 1, 2`,
+	Destination: `select intDiv(toUnixTimestamp64Milli(created_at), 86400000) as day, workspace_id, count() as row_count,
+		` + chHash(`concat(id, '|', user_id, '|', category, '|', action, '|',
+			toString(intDiv(toUnixTimestamp64Milli(created_at), 1000)))`) + ` as hash
+		from audits final where created_at > toDateTime64(0, 3)%s group by day, workspace_id`,
+}
 
-		err := ch.Create(chAudits).Error
-		if err != nil {
-			log.Println("Migrate audits failed on create", err)
-			return
+var AuditsMigration = &Definition[AuditPG, Audit]{
+	Table:         "audits",
+	Destination:   "audits",
+	DestKeyAt:     "created_at",
+	DestKeyID:     "id",
+	Source:        "workspace.audit",
+	Query:         auditsQuery,
+	KeyAt:         "a.done_at",
+	KeyID:         "a.id",
+	Workspace:     "a.workspace_id",
+	DestWorkspace: "workspace_id",
+	Changed:       []string{"a.done_at"},
+	Bounds:        `select min(done_at), max(done_at) from workspace.audit`,
+	Count: `select count(*) from workspace.audit a
+		inner join workspace.users u on a.user_id = u.id`,
+	Verification: auditsVerification,
+	Columns:      auditColumns,
+	Values:       auditValues,
+	Scan:         scanAuditPG,
+	Key: func(a *AuditPG) (null.Time, string) {
+		return a.DoneAt, a.ID
+	},
+	Convert: func(a *AuditPG) (*Audit, error) {
+		if !a.DoneAt.Valid {
+			return nil, fmt.Errorf("done_at is null")
+		}
+		for _, c := range []struct {
+			name  string
+			value []byte
+		}{{"data", a.Data}, {"previous_state", a.PreviousState}, {"next_state", a.NextState}} {
+			if len(c.value) > 0 && !json.Valid(c.value) {
+				return nil, fmt.Errorf("%s is not valid json", c.name)
+			}
 		}
+		return a.Audit(), nil
+	},
+}
 
-		log.Println("Migration page completed:", page)
-		page++
-	}
+func MigrateAudits(ctx context.Context) error {
+	return AuditsMigration.Migrate(ctx)
 }
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"clickhouse-migrations/config"
+)
+
+// BenchResult is the throughput of one writer inserting synthetic rows.
+type BenchResult struct {
+	Table    string
+	Writer   string
+	Rows     int
+	Duration time.Duration
+}
+
+func (r *BenchResult) RowsPerSecond() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Rows) / r.Duration.Seconds()
+}
+
+// Bench inserts n synthetic rows of table in batches of
+// migration.batchsize with the GORM and the native writer, each into a
+// fresh copy of the destination table in the bench.database scratch
+// database dropped afterwards, and returns the throughput of both. It
+// refuses to run without a scratch database other than the migrated one,
+// so it never drops a table the migration writes.
+func Bench(ctx context.Context, table string, n int) ([]*BenchResult, error) {
+	scratch := config.Config.Bench.Database
+	if scratch == "" {
+		return nil, fmt.Errorf("Bench needs a scratch database to create and drop tables in, set bench.database")
+	}
+	var current string
+	if err := ch.WithContext(ctx).Raw("select currentDatabase()").Scan(&current).Error; err != nil {
+		return nil, fmt.Errorf("Bench failed: %s", err.Error())
+	}
+	if scratch == current {
+		return nil, fmt.Errorf("Bench database %s is the migrated database, expected a scratch one", scratch)
+	}
+
+	switch table {
+	case JobsMigration.Table:
+		return bench(ctx, JobsMigration, scratch, n, benchJob)
+	case AuditsMigration.Table:
+		return bench(ctx, AuditsMigration, scratch, n, benchAudit)
+	}
+	return nil, fmt.Errorf("no benchmark for table %q, expected jobs or audits", table)
+}
+
+func bench[S any, D any](ctx context.Context, d *Definition[S, D], database string, n int, gen func(i int, workspaces []string) *D) ([]*BenchResult, error) {
+	workspaces := make([]string, 100)
+	for i := range workspaces {
+		workspaces[i] = uuid.NewString()
+	}
+	rows := make([]*D, n)
+	for i := range rows {
+		rows[i] = gen(i, workspaces)
+	}
+
+	scratch := database + "." + d.Destination
+	writers := []struct {
+		name   string
+		insert func(ctx context.Context, rows []*D) error
+	}{
+		{"gorm", func(ctx context.Context, rows []*D) error {
+			return ch.WithContext(ctx).Table(scratch).Create(rows).Error
+		}},
+		{"native", func(ctx context.Context, rows []*D) error {
+			return d.insertNative(ctx, scratch, rows)
+		}},
+	}
+
+	var results []*BenchResult
+	for _, w := range writers {
+		r := &BenchResult{Table: d.Table, Writer: w.name, Rows: n}
+		if err := benchWriter(ctx, d.Destination, scratch, rows, w.insert, r); err != nil {
+			return results, fmt.Errorf("Bench %s with %s failed: %s", d.Table, w.name, err.Error())
+		}
+		slog.Info("Bench completed", "table", d.Table, "writer", w.name, "rows", r.Rows,
+			"duration", r.Duration, "rows_per_second", int64(r.RowsPerSecond()))
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// benchWriter times inserting rows into scratch, created as a copy of
+// destination beforehand and dropped afterwards, and records it in r.
+func benchWriter[D any](ctx context.Context, destination, scratch string, rows []*D, insert func(ctx context.Context, rows []*D) error, r *BenchResult) error {
+	if err := ch.WithContext(ctx).Exec(fmt.Sprintf("drop table if exists %s", scratch)).Error; err != nil {
+		return err
+	}
+	if err := ch.WithContext(ctx).Exec(fmt.Sprintf("create table %s as %s", scratch, destination)).Error; err != nil {
+		return err
+	}
+	defer func() {
+		if err := ch.Exec(fmt.Sprintf("drop table if exists %s", scratch)).Error; err != nil {
+			slog.Warn("Drop bench table failed", "table", scratch, "error", err)
+		}
+	}()
+
+	size := config.Config.Migration.BatchSize
+	start := time.Now()
+	for i := 0; i < len(rows); i += size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := insert(ctx, rows[i:min(i+size, len(rows))]); err != nil {
+			return err
+		}
+	}
+	r.Duration = time.Since(start)
+	return nil
+}
+
+var benchStart = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// benchJob returns the i-th synthetic job, shaped like a finished run.
+func benchJob(i int, workspaces []string) *Job {
+	var (
+		runAt     = benchStart.Add(time.Duration(i) * time.Second)
+		stoppedAt = runAt.Add(time.Duration(i%600) * time.Second)
+		flowID    = uuid.NewString()
+		version   = fmt.Sprintf("v%d", i%20)
+	)
+	return &Job{
+		ID:              uuid.NewString(),
+		RobotID:         uuid.NewString(),
+		WorkspaceID:     workspaces[i%len(workspaces)],
+		FlowID:          &flowID,
+		PublishedFlowID: &flowID,
+		RobotType:       int64(i % len(RobotTypes)),
+		RunAt:           runAt,
+		StoppedAt:       &stoppedAt,
+		RunningTime:     int64(i % 600),
+		Status:          STATUS[int64(2+i%3)],
+		Data:            fmt.Sprintf(`{"steps":%d,"output":"run %d finished"}`, i%50, i),
+		RobotName:       fmt.Sprintf("robot %d", i%1000),
+		FlowName:        fmt.Sprintf("flow %d", i%500),
+		VersionName:     &version,
+		CreatedAt:       runAt,
+		UpdatedAt:       stoppedAt,
+	}
+}
+
+// benchAudit returns the i-th synthetic audit, shaped like a settings change.
+func benchAudit(i int, workspaces []string) *Audit {
+	return &Audit{
+		ID:            uuid.NewString(),
+		WorkspaceID:   workspaces[i%len(workspaces)],
+		UserID:        uuid.NewString(),
+		Category:      "robot",
+		Action:        []string{"create", "update", "delete"}[i%3],
+		Description:   fmt.Sprintf("Robot %d changed", i%1000),
+		Data:          []byte(fmt.Sprintf(`{"robot":%d}`, i%1000)),
+		PreviousState: []byte(fmt.Sprintf(`{"name":"robot %d","enabled":false}`, i%1000)),
+		NextState:     []byte(fmt.Sprintf(`{"name":"robot %d","enabled":true}`, i%1000)),
+		CreatedAt:     benchStart.Add(time.Duration(i) * time.Second),
+	}
+}
@@ -0,0 +1,193 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	chproto "github.com/ClickHouse/ch-go/proto"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/column"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/proto"
+	"github.com/google/uuid"
+	"gorm.io/driver/clickhouse"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"clickhouse-migrations/config"
+)
+
+// benchBatch is how many rows the writer benchmarks insert per batch.
+const benchBatch = 10_000
+
+func BenchmarkWriteJobs(b *testing.B) {
+	benchmarkWriters(b, JobsMigration, benchJob)
+}
+
+func BenchmarkWriteAudits(b *testing.B) {
+	benchmarkWriters(b, AuditsMigration, benchAudit)
+}
+
+func TestBenchNeedsScratchDatabase(t *testing.T) {
+	config.Config = config.Default
+	if _, err := Bench(context.Background(), "jobs", 10); err == nil || !strings.Contains(err.Error(), "bench.database") {
+		t.Errorf("Bench() = %v, want a scratch database required", err)
+	}
+}
+
+// benchmarkWriters compares the client side of the GORM and the native
+// writer inserting a batch of synthetic rows: both end with the batch
+// encoded as the blocks clickhouse-go sends, but nothing is sent.
+func benchmarkWriters[S any, D any](b *testing.B, d *Definition[S, D], gen func(i int, workspaces []string) *D) {
+	schema := LookupSchema(d.Destination)
+	workspaces := make([]string, 10)
+	for i := range workspaces {
+		workspaces[i] = uuid.NewString()
+	}
+	rows := make([]*D, benchBatch)
+	for i := range rows {
+		rows[i] = gen(i, workspaces)
+	}
+
+	b.Run("gorm", func(b *testing.B) {
+		conn := &blockConn{schema: schema}
+		gdb, err := gorm.Open(clickhouse.New(clickhouse.Config{
+			Conn:                      sql.OpenDB(conn),
+			SkipInitializeWithVersion: true,
+		}), &gorm.Config{Logger: logger.Discard, DisableAutomaticPing: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := gdb.Table(d.Destination).Create(rows).Error; err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(conn.bytes)/float64(b.N), "B/batch")
+	})
+
+	b.Run("native", func(b *testing.B) {
+		var (
+			buf   chproto.Buffer
+			bytes int
+			size  = config.Default.Insert.BlockSize
+		)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for start := 0; start < len(rows); start += size {
+				block, err := newBlock(schema, d.Columns)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for c, values := range d.Values(rows[start:min(start+size, len(rows))]) {
+					if _, err := block.Columns[c].Append(values); err != nil {
+						b.Fatalf("append %s: %s", d.Columns[c], err)
+					}
+				}
+				buf.Reset()
+				if err := block.Encode(&buf, proto.DBMS_TCP_PROTOCOL_VERSION); err != nil {
+					b.Fatal(err)
+				}
+				bytes += len(buf.Buf)
+			}
+		}
+		b.ReportMetric(float64(bytes)/float64(b.N), "B/batch")
+	})
+}
+
+// newBlock returns an empty block of columns typed as in schema.
+func newBlock(schema *TableSchema, columns []string) (*proto.Block, error) {
+	types := make(map[string]string)
+	for _, c := range schema.Columns {
+		types[c.Name] = c.Type
+	}
+
+	block := &proto.Block{}
+	for _, name := range columns {
+		t, ok := types[name]
+		if !ok {
+			return nil, fmt.Errorf("column %s is not in table %s", name, schema.Name)
+		}
+		if err := block.AddColumn(name, column.Type(t)); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// blockConn is a ClickHouse connection that, like the clickhouse-go
+// database/sql driver, appends the rows of a prepared insert to a block
+// and encodes the block when the statement is closed, instead of sending
+// it. bytes counts the encoded bytes.
+type blockConn struct {
+	schema *TableSchema
+	bytes  int
+}
+
+func (c *blockConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *blockConn) Driver() driver.Driver                        { return nil }
+
+func (c *blockConn) Prepare(query string) (driver.Stmt, error) {
+	start, end := strings.Index(query, "("), strings.Index(query, ")")
+	if !strings.HasPrefix(query, "INSERT INTO") || start < 0 || end < start {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+
+	var columns []string
+	for _, name := range strings.Split(query[start+1:end], ",") {
+		columns = append(columns, strings.Trim(name, "` "))
+	}
+	block, err := newBlock(c.schema, columns)
+	if err != nil {
+		return nil, err
+	}
+	return &blockStmt{conn: c, block: block}, nil
+}
+
+func (c *blockConn) Close() error              { return nil }
+func (c *blockConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *blockConn) Commit() error             { return nil }
+func (c *blockConn) Rollback() error           { return nil }
+
+// CheckNamedValue passes row values to the block as they are, as
+// clickhouse-go does.
+func (c *blockConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type blockStmt struct {
+	conn  *blockConn
+	block *proto.Block
+}
+
+func (s *blockStmt) NumInput() int { return -1 }
+
+func (s *blockStmt) Exec(args []driver.Value) (driver.Result, error) {
+	row := make([]interface{}, len(args))
+	for i, v := range args {
+		row[i] = v
+	}
+	if err := s.block.Append(row...); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *blockStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("blockStmt does not query")
+}
+
+func (s *blockStmt) Close() error {
+	var buf chproto.Buffer
+	if err := s.block.Encode(&buf, proto.DBMS_TCP_PROTOCOL_VERSION); err != nil {
+		return err
+	}
+	s.conn.bytes += len(buf.Buf)
+	return nil
+}
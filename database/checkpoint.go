@@ -0,0 +1,326 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"clickhouse-migrations/config"
+)
+
+// Checkpoint records how far a migration of one key range of a table got.
+// LastKey is an opaque position understood only by the migration that
+// wrote it. Rows counts the rows inserted and Read the source rows gone
+// through, including those left out.
+type Checkpoint struct {
+	RunID     string    `json:"run_id"`
+	Table     string    `json:"table"`
+	Range     string    `json:"range"`
+	LastKey   string    `json:"last_key"`
+	Rows      int64     `json:"rows"`
+	Read      int64     `json:"read"`
+	Done      bool      `json:"done"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CheckpointStore interface {
+	// Load returns the latest checkpoint of every range of table.
+	Load(table string) ([]*Checkpoint, error)
+	Save(cp *Checkpoint) error
+}
+
+var (
+	checkpoints CheckpointStore
+
+	// runID identifies this process in checkpoints of newly started runs.
+	runID = uuid.NewString()
+)
+
+// InitCheckpoints opens the checkpoint store selected in the config. It has
+// to be called after InitDB and InitClickHouse.
+func InitCheckpoints() error {
+	var (
+		cfg = config.Config.Checkpoint
+		err error
+	)
+
+	switch cfg.Store {
+	case "file":
+		checkpoints = &fileCheckpointStore{path: cfg.Path}
+	case "postgres":
+		checkpoints, err = newPGCheckpointStore(cfg.Table)
+	case "clickhouse":
+		checkpoints, err = newCHCheckpointStore(cfg.Table)
+	default:
+		err = fmt.Errorf("unknown checkpoint store %q", cfg.Store)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Checkpoint store error: %s", err.Error())
+	}
+
+	return nil
+}
+
+// OpenCheckpoints opens the checkpoint store selected in the config for
+// reading without creating it, so a dry run issues no DDL. A store no run
+// created yet holds no checkpoints.
+func OpenCheckpoints(ctx context.Context) error {
+	var (
+		cfg    = config.Config.Checkpoint
+		exists = true
+		err    error
+	)
+
+	switch cfg.Store {
+	case "file":
+		checkpoints = &fileCheckpointStore{path: cfg.Path}
+		return nil
+	case "postgres":
+		err = db.Db.QueryRowContext(ctx, `select to_regclass($1) is not null`, cfg.Table).Scan(&exists)
+		checkpoints = &pgCheckpointStore{table: cfg.Table}
+	case "clickhouse":
+		var n int64
+		err = ch.WithContext(ctx).Raw(`select count() from system.tables
+			where database = currentDatabase() and name = ?`, cfg.Table).Scan(&n).Error
+		exists = n > 0
+		checkpoints = &chCheckpointStore{table: cfg.Table}
+	default:
+		err = fmt.Errorf("unknown checkpoint store %q", cfg.Store)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Checkpoint store error: %s", err.Error())
+	}
+	if !exists {
+		checkpoints = emptyCheckpointStore{}
+	}
+
+	return nil
+}
+
+// startCheckpoints returns the checkpoint every range of table continues
+// from. Without resume, or for ranges without a stored checkpoint, it starts
+// a new run.
+func startCheckpoints(table string, ranges []*keyRange) ([]*Checkpoint, error) {
+	stored := map[string]*Checkpoint{}
+	if config.Config.Migration.Resume {
+		cps, err := checkpoints.Load(table)
+		if err != nil {
+			return nil, fmt.Errorf("Load %s checkpoints failed: %s", table, err.Error())
+		}
+		for _, cp := range cps {
+			stored[cp.Range] = cp
+		}
+	}
+
+	cps := make([]*Checkpoint, len(ranges))
+	for i, r := range ranges {
+		cps[i] = stored[r.Name]
+		if cps[i] == nil {
+			cps[i] = &Checkpoint{RunID: runID, Table: table, Range: r.Name}
+		}
+	}
+	return cps, nil
+}
+
+func saveCheckpoint(cp *Checkpoint) error {
+	cp.UpdatedAt = time.Now()
+	if err := checkpoints.Save(cp); err != nil {
+		return fmt.Errorf("Save %s checkpoint of range %s failed: %s", cp.Table, cp.Range, err.Error())
+	}
+	return nil
+}
+
+// -- emptyCheckpointStore
+// emptyCheckpointStore stands in for a store opened read only before any
+// run created it.
+type emptyCheckpointStore struct{}
+
+func (emptyCheckpointStore) Load(table string) ([]*Checkpoint, error) {
+	return nil, nil
+}
+
+func (emptyCheckpointStore) Save(cp *Checkpoint) error {
+	return errors.New("checkpoint store is read only")
+}
+
+// -- fileCheckpointStore
+type fileCheckpointStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileCheckpointStore) read() (map[string]*Checkpoint, error) {
+	m := map[string]*Checkpoint{}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *fileCheckpointStore) Load(table string) ([]*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var cps []*Checkpoint
+	for _, cp := range m {
+		if cp.Table == table {
+			cps = append(cps, cp)
+		}
+	}
+	return cps, nil
+}
+
+func (s *fileCheckpointStore) Save(cp *Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.read()
+	if err != nil {
+		return err
+	}
+	m[cp.Table+"/"+cp.Range] = cp
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic writes to a temp file and renames it to path, so a crash
+// never leaves a torn file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// -- pgCheckpointStore
+type pgCheckpointStore struct {
+	table string
+}
+
+func newPGCheckpointStore(table string) (*pgCheckpointStore, error) {
+	_, err := db.Exec(fmt.Sprintf(`create table if not exists %s (
+		table_name text not null,
+		range_name text not null,
+		run_id text not null,
+		last_key text not null,
+		rows bigint not null,
+		read_rows bigint not null,
+		done boolean not null,
+		updated_at timestamptz not null,
+		primary key (table_name, range_name)
+	)`, table))
+	if err != nil {
+		return nil, err
+	}
+	return &pgCheckpointStore{table: table}, nil
+}
+
+func (s *pgCheckpointStore) Load(table string) ([]*Checkpoint, error) {
+	var cps []*Checkpoint
+	query := fmt.Sprintf(`select table_name, range_name, run_id, last_key, rows, read_rows, done, updated_at
+		from %s where table_name = $1`, s.table)
+
+	rows, err := db.Db.Query(query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		cp := &Checkpoint{}
+		if err := rows.Scan(&cp.Table, &cp.Range, &cp.RunID, &cp.LastKey, &cp.Rows, &cp.Read, &cp.Done, &cp.UpdatedAt); err != nil {
+			return nil, err
+		}
+		cps = append(cps, cp)
+	}
+	return cps, rows.Err()
+}
+
+func (s *pgCheckpointStore) Save(cp *Checkpoint) error {
+	_, err := db.Exec(fmt.Sprintf(`insert into %s (table_name, range_name, run_id, last_key, rows, read_rows, done, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+		on conflict (table_name, range_name) do update set run_id = excluded.run_id, last_key = excluded.last_key,
+		rows = excluded.rows, read_rows = excluded.read_rows, done = excluded.done, updated_at = excluded.updated_at`, s.table),
+		cp.Table, cp.Range, cp.RunID, cp.LastKey, cp.Rows, cp.Read, cp.Done, cp.UpdatedAt)
+	return err
+}
+
+// -- chCheckpointStore
+type chCheckpointStore struct {
+	table string
+}
+
+func newCHCheckpointStore(table string) (*chCheckpointStore, error) {
+	err := ch.Exec(fmt.Sprintf(`create table if not exists %s (
+		table_name String,
+		range_name String,
+		run_id String,
+		last_key String,
+		rows Int64,
+		read_rows Int64,
+		done Bool,
+		updated_at DateTime64(3)
+	) engine = ReplacingMergeTree(updated_at) order by (table_name, range_name)`, table)).Error
+	if err != nil {
+		return nil, err
+	}
+	return &chCheckpointStore{table: table}, nil
+}
+
+func (s *chCheckpointStore) Load(table string) ([]*Checkpoint, error) {
+	var cps []*Checkpoint
+	query := fmt.Sprintf(`select table_name as "table", range_name as "range", run_id, last_key, rows, read_rows as "read", done, updated_at
+		from %s final where table_name = ?`, s.table)
+
+	if err := ch.Raw(query, table).Scan(&cps).Error; err != nil {
+		return nil, err
+	}
+	return cps, nil
+}
+
+func (s *chCheckpointStore) Save(cp *Checkpoint) error {
+	return ch.Exec(fmt.Sprintf(`insert into %s (table_name, range_name, run_id, last_key, rows, read_rows, done, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`, s.table),
+		cp.Table, cp.Range, cp.RunID, cp.LastKey, cp.Rows, cp.Read, cp.Done, cp.UpdatedAt).Error
+}
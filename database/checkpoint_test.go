@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"clickhouse-migrations/config"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir := t.TempDir()
+	s := &fileCheckpointStore{path: filepath.Join(dir, "checkpoints.json")}
+
+	cps, err := s.Load("jobs")
+	if err != nil || len(cps) != 0 {
+		t.Fatalf("Load() of a missing file = %v, %v, want nothing", cps, err)
+	}
+
+	saved := []*Checkpoint{
+		{RunID: "r1", Table: "jobs", Range: "2023-05", LastKey: `{"At":"2023-05-02T00:00:00Z","ID":"a"}`, Rows: 10},
+		{RunID: "r1", Table: "jobs", Range: "null", Done: true},
+		{RunID: "r1", Table: "audits", Range: "2023-05", Rows: 3},
+		// a later save of a range replaces the earlier one
+		{RunID: "r1", Table: "jobs", Range: "2023-05", LastKey: `{"At":"2023-05-03T00:00:00Z","ID":"b"}`, Rows: 20},
+	}
+	for _, cp := range saved {
+		if err := s.Save(cp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cps, err = s.Load("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(cps, func(i, j int) bool { return cps[i].Range < cps[j].Range })
+	if len(cps) != 2 {
+		t.Fatalf("Load() returned %d checkpoints, want 2", len(cps))
+	}
+	if cp := cps[0]; cp.Range != "2023-05" || cp.LastKey != saved[3].LastKey || cp.Rows != 20 || cp.Done {
+		t.Errorf("range 2023-05 = %+v, want the last save", cp)
+	}
+	if cp := cps[1]; cp.Range != "null" || !cp.Done {
+		t.Errorf("range null = %+v, want it done", cp)
+	}
+
+	// the file is replaced by a rename, without temp files left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the checkpoint file", len(entries))
+	}
+}
+
+func TestFileCheckpointStoreCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fileCheckpointStore{path: path}
+	if _, err := s.Load("jobs"); err == nil {
+		t.Error("Load() of a corrupt file succeeded")
+	}
+	if err := s.Save(&Checkpoint{Table: "jobs", Range: "all"}); err == nil {
+		t.Error("Save() over a corrupt file succeeded")
+	}
+}
+
+func TestStartCheckpoints(t *testing.T) {
+	config.Config = config.Default
+	defer func(resume bool) { config.Config.Migration.Resume = resume }(config.Config.Migration.Resume)
+	checkpoints = &fileCheckpointStore{path: filepath.Join(t.TempDir(), "checkpoints.json")}
+	defer func() { checkpoints = nil }()
+
+	stored := &Checkpoint{RunID: "earlier", Table: "jobs", Range: "2023-05", LastKey: "k", Rows: 10}
+	if err := saveCheckpoint(stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.UpdatedAt.IsZero() {
+		t.Error("saveCheckpoint() did not set UpdatedAt")
+	}
+	ranges := []*keyRange{{Name: "2023-05"}, {Name: "null", Null: true}}
+
+	tests := []struct {
+		name   string
+		resume bool
+		runs   []string
+		rows   []int64
+	}{
+		{name: "fresh run", runs: []string{runID, runID}, rows: []int64{0, 0}},
+		{name: "resume", resume: true, runs: []string{"earlier", runID}, rows: []int64{10, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.Migration.Resume = tt.resume
+			cps, err := startCheckpoints("jobs", ranges)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, cp := range cps {
+				if cp.Table != "jobs" || cp.Range != ranges[i].Name || cp.RunID != tt.runs[i] || cp.Rows != tt.rows[i] {
+					t.Errorf("checkpoint %d = %+v, want run %s with %d rows", i, cp, tt.runs[i], tt.rows[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOpenCheckpoints(t *testing.T) {
+	config.Config = config.Default
+	defer func(cfg config.Checkpoint) { config.Config.Checkpoint = cfg }(config.Config.Checkpoint)
+	defer func() { checkpoints = nil }()
+
+	dir := t.TempDir()
+	config.Config.Checkpoint.Store, config.Config.Checkpoint.Path = "file", filepath.Join(dir, "checkpoints.json")
+	if err := OpenCheckpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cps, err := checkpoints.Load("jobs"); err != nil || len(cps) != 0 {
+		t.Errorf("Load() = %v, %v, want nothing", cps, err)
+	}
+	// opening reads only, so no file is created
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("dir holds %d entries, %v, want none", len(entries), err)
+	}
+
+	config.Config.Checkpoint.Store = "redis"
+	if err := OpenCheckpoints(context.Background()); err == nil {
+		t.Error("OpenCheckpoints() of an unknown store succeeded")
+	}
+}
+
+func TestEmptyCheckpointStore(t *testing.T) {
+	s := emptyCheckpointStore{}
+	if cps, err := s.Load("jobs"); err != nil || len(cps) != 0 {
+		t.Errorf("Load() = %v, %v, want nothing", cps, err)
+	}
+	if err := s.Save(&Checkpoint{Table: "jobs"}); err == nil {
+		t.Error("Save() succeeded, want the store read only")
+	}
+}
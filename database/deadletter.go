@@ -0,0 +1,440 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"clickhouse-migrations/config"
+)
+
+// Stages a row can fail at. A row failing conversion is kept as the source
+// row S, a row rejected by ClickHouse as the destination row D.
+const (
+	stageConvert = "convert"
+	stageInsert  = "insert"
+)
+
+// DeadLetter is a row left out of a migration, with the stage that failed
+// and why, kept until it is replayed. Row shows the row as JSON, or as a
+// JSON string of its text when it cannot be encoded as JSON, e.g. a job
+// whose data is not valid JSON. Data is the row gob encoded, which keeps
+// the bytes and Go types JSON loses, and is what replay decodes.
+type DeadLetter struct {
+	ID        string          `json:"id"`
+	RunID     string          `json:"run_id"`
+	Table     string          `json:"table"`
+	Stage     string          `json:"stage"`
+	Error     string          `json:"error"`
+	Row       json.RawMessage `json:"row"`
+	Data      []byte          `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Replayable reports whether the row of l can be decoded by replay.
+func (l *DeadLetter) Replayable() bool {
+	return len(l.Data) > 0
+}
+
+type DeadLetterStore interface {
+	Save(l *DeadLetter) error
+	// Load returns the dead letters of table, oldest first.
+	Load(table string) ([]*DeadLetter, error)
+	Remove(ids []string) error
+}
+
+// deadLetters is nil when deadletter.sink is none; failing rows then fail
+// the migration.
+var deadLetters DeadLetterStore
+
+// InitDeadLetters opens the dead letter sink selected in the config. It has
+// to be called after InitDB and InitClickHouse.
+func InitDeadLetters() error {
+	var (
+		cfg = config.Config.DeadLetter
+		err error
+	)
+
+	switch cfg.Sink {
+	case "none":
+	case "file":
+		deadLetters = &fileDeadLetterStore{path: cfg.Path}
+	case "clickhouse":
+		deadLetters, err = newCHDeadLetterStore(cfg.Table)
+	default:
+		err = fmt.Errorf("unknown dead letter sink %q", cfg.Sink)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Dead letter sink error: %s", err.Error())
+	}
+
+	return nil
+}
+
+// reject dead letters row, which failed at stage with cause. Without a
+// sink it returns cause.
+func (d *Definition[S, D]) reject(ctx context.Context, stage string, row interface{}, cause error) error {
+	if deadLetters == nil {
+		return cause
+	}
+
+	l := &DeadLetter{
+		ID:        uuid.NewString(),
+		RunID:     runID,
+		Table:     d.Table,
+		Stage:     stage,
+		Error:     cause.Error(),
+		CreatedAt: time.Now(),
+	}
+	if data, err := json.Marshal(row); err == nil {
+		l.Row = data
+	} else {
+		l.Row, _ = json.Marshal(fmt.Sprintf("%+v", row))
+	}
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(row); err != nil {
+		// keep what is known about the row even if it cannot be replayed
+		slog.Warn("Dead lettered row cannot be encoded for replay", "table", d.Table, "error", err)
+	} else {
+		l.Data = data.Bytes()
+	}
+	if err := Retry(ctx, fmt.Sprintf("Dead letter %s row", d.Table), func() error { return deadLetters.Save(l) }); err != nil {
+		return fmt.Errorf("Dead letter %s row failed: %s (row failed on %s: %s)", d.Table, err.Error(), stage, cause.Error())
+	}
+
+	deadLettered.WithLabelValues(d.Table, stage).Inc()
+	updateReport(d.Table, func(t *TableReport) { t.DeadLetters++ })
+	slog.Warn("Dead lettered a row", "table", d.Table, "stage", stage, "error", cause)
+	return nil
+}
+
+// write inserts rows and returns how many it inserted. When a batch fails
+// with an error that is not retryable it is split in halves until the
+// rows ClickHouse rejects are found and dead lettered.
+func (d *Definition[S, D]) write(ctx context.Context, rows []*D) (int, error) {
+	err := d.insert(ctx, rows)
+	if err == nil {
+		countWritten(d.Table, len(rows))
+		return len(rows), nil
+	}
+	if deadLetters == nil || retryable(err) {
+		return 0, err
+	}
+
+	if len(rows) == 1 {
+		return 0, d.reject(ctx, stageInsert, rows[0], err)
+	}
+
+	half := len(rows) / 2
+	n, err := d.write(dedupPart(ctx, "0"), rows[:half])
+	if err != nil {
+		return n, err
+	}
+	m, err := d.write(dedupPart(ctx, "1"), rows[half:])
+	return n + m, err
+}
+
+// Replay converts and inserts the dead lettered rows of the table again,
+// e.g. after a conversion bug or the destination schema is fixed. Rows
+// that succeed are removed from the sink; rows that still fail stay.
+func (d *Definition[S, D]) Replay(ctx context.Context) (replayed int64, err error) {
+	ctx, span := startTable(ctx, "replay", d.Table, d.Destination)
+	defer func() {
+		span.SetAttributes(attribute.Int64("rows", replayed))
+		finishReport(d.Table, err)
+		endSpan(span, err)
+	}()
+
+	if deadLetters == nil {
+		return 0, fmt.Errorf("No dead letter sink configured")
+	}
+
+	letters, err := deadLetters.Load(d.Table)
+	if err != nil {
+		return 0, fmt.Errorf("Load %s dead letters failed: %s", d.Table, err.Error())
+	}
+
+	var (
+		done []string
+		ids  []string
+		rows []*D
+	)
+
+	// flush inserts the pending rows in one batch, or one at a time if
+	// the batch is rejected, leaving rows that still fail in the sink.
+	flush := func() error {
+		defer func() { ids, rows = ids[:0], rows[:0] }()
+
+		err := d.insert(withDedupToken(ctx, dedupToken(append([]string{d.Table, "replay"}, ids...)...)), rows)
+		if err == nil {
+			countWritten(d.Table, len(rows))
+			done = append(done, ids...)
+			replayed += int64(len(rows))
+			return nil
+		}
+		if retryable(err) {
+			return fmt.Errorf("Replay %s failed on create: %s", d.Table, err.Error())
+		}
+
+		for i, row := range rows {
+			if err := d.insert(withDedupToken(ctx, dedupToken(d.Table, "replay", ids[i])), []*D{row}); err != nil {
+				slog.Warn("Dead letter still fails", "table", d.Table, "id", ids[i], "error", err)
+				continue
+			}
+			countWritten(d.Table, 1)
+			done = append(done, ids[i])
+			replayed++
+		}
+		return nil
+	}
+
+	var skipped int
+	for _, l := range letters {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if !l.Replayable() {
+			skipped++
+			continue
+		}
+		out, err := d.revive(l)
+		if err != nil {
+			slog.Warn("Dead letter still fails", "table", d.Table, "id", l.ID, "error", err)
+			continue
+		}
+		if out == nil {
+			done = append(done, l.ID)
+			continue
+		}
+
+		ids, rows = append(ids, l.ID), append(rows, out)
+		if len(rows) < config.Config.Migration.BatchSize {
+			continue
+		}
+		if err := flush(); err != nil {
+			return replayed, err
+		}
+	}
+	if len(rows) > 0 {
+		if err := flush(); err != nil {
+			return replayed, err
+		}
+	}
+
+	if len(done) > 0 {
+		if err := deadLetters.Remove(done); err != nil {
+			return replayed, fmt.Errorf("Remove %s dead letters failed: %s", d.Table, err.Error())
+		}
+	}
+
+	if skipped > 0 {
+		slog.Warn("Skipped dead letters without a row to replay", "table", d.Table, "dead_letters", skipped)
+	}
+	slog.Info("Replay completed", "table", d.Table, "rows", replayed, "dead_letters", len(letters), "left", len(letters)-len(done))
+	return replayed, nil
+}
+
+// revive decodes the row of l and converts it again if it failed
+// conversion. A nil row without an error is dropped by Convert.
+func (d *Definition[S, D]) revive(l *DeadLetter) (*D, error) {
+	switch l.Stage {
+	case stageConvert:
+		row := new(S)
+		if err := decodeRow(l.Data, row); err != nil {
+			return nil, fmt.Errorf("cannot decode row: %s", err.Error())
+		}
+		return d.Convert(row)
+	case stageInsert:
+		out := new(D)
+		if err := decodeRow(l.Data, out); err != nil {
+			return nil, fmt.Errorf("cannot decode row: %s", err.Error())
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown stage %q", l.Stage)
+}
+
+// decodeRow decodes the Data of a dead letter into row, a pointer to the
+// type that was rejected.
+func decodeRow(data []byte, row interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(row)
+}
+
+// -- fileDeadLetterStore appends one JSON dead letter per line.
+type fileDeadLetterStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileDeadLetterStore) read() ([]*DeadLetter, error) {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []*DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		l := &DeadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), l); err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+	return letters, scanner.Err()
+}
+
+func (s *fileDeadLetterStore) Save(l *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileDeadLetterStore) Load(table string) ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var letters []*DeadLetter
+	for _, l := range all {
+		if l.Table == table {
+			letters = append(letters, l)
+		}
+	}
+	return letters, nil
+}
+
+func (s *fileDeadLetterStore) Remove(ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		removed[id] = struct{}{}
+	}
+
+	var buf bytes.Buffer
+	for _, l := range all {
+		if _, ok := removed[l.ID]; ok {
+			continue
+		}
+		data, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(s.path, buf.Bytes())
+}
+
+// -- chDeadLetterStore
+type chDeadLetterStore struct {
+	table string
+}
+
+type chDeadLetter struct {
+	ID        string
+	RunID     string
+	Table     string
+	Stage     string
+	Error     string
+	Row       string
+	Data      string
+	CreatedAt time.Time
+}
+
+func newCHDeadLetterStore(table string) (*chDeadLetterStore, error) {
+	err := ch.Exec(fmt.Sprintf(`create table if not exists %s (
+		id String,
+		run_id String,
+		table_name String,
+		stage LowCardinality(String),
+		error String,
+		row String,
+		data String,
+		created_at DateTime64(3)
+	) engine = MergeTree order by (table_name, created_at)`, table)).Error
+	if err != nil {
+		return nil, err
+	}
+	return &chDeadLetterStore{table: table}, nil
+}
+
+func (s *chDeadLetterStore) Save(l *DeadLetter) error {
+	return ch.Exec(fmt.Sprintf(`insert into %s (id, run_id, table_name, stage, error, row, data, created_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`, s.table),
+		l.ID, l.RunID, l.Table, l.Stage, l.Error, string(l.Row), base64.StdEncoding.EncodeToString(l.Data), l.CreatedAt).Error
+}
+
+func (s *chDeadLetterStore) Load(table string) ([]*DeadLetter, error) {
+	var rows []*chDeadLetter
+	query := fmt.Sprintf(`select id, run_id, table_name as "table", stage, error, row, data, created_at
+		from %s where table_name = ? order by created_at`, s.table)
+
+	if err := ch.Raw(query, table).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	letters := make([]*DeadLetter, len(rows))
+	for i, r := range rows {
+		data, err := base64.StdEncoding.DecodeString(r.Data)
+		if err != nil {
+			return nil, fmt.Errorf("dead letter %s has invalid data: %s", r.ID, err.Error())
+		}
+		letters[i] = &DeadLetter{ID: r.ID, RunID: r.RunID, Table: r.Table, Stage: r.Stage, Error: r.Error,
+			Row: json.RawMessage(r.Row), Data: data, CreatedAt: r.CreatedAt}
+	}
+	return letters, nil
+}
+
+// Remove deletes with a synchronous mutation, so a replay right after
+// does not see the removed rows again.
+func (s *chDeadLetterStore) Remove(ids []string) error {
+	return ch.Exec(fmt.Sprintf(`alter table %s delete where id in ? settings mutations_sync = 1`, s.table), ids).Error
+}
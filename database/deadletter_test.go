@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+
+	"clickhouse-migrations/config"
+)
+
+// useDeadLetterFile points the package at a dead letter file in a temp dir
+// for the duration of the test.
+func useDeadLetterFile(t *testing.T) {
+	config.Config = config.Default
+	deadLetters = &fileDeadLetterStore{path: filepath.Join(t.TempDir(), "dead_letters.ndjson")}
+	t.Cleanup(func() { deadLetters = nil })
+}
+
+func TestRejectInvalidJSONRows(t *testing.T) {
+	useDeadLetterFile(t)
+
+	runAt := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	valid := &JobEntry{JobPG: JobPG{ID: "valid", RunAt: null.TimeFrom(runAt), Data: JSONB(`{"a":1}`)}}
+	invalid := &JobEntry{JobPG: JobPG{ID: "invalid", RunAt: null.TimeFrom(runAt), Data: JSONB(`{"a":`)}}
+	for _, row := range []*JobEntry{valid, invalid} {
+		if err := JobsMigration.reject(context.Background(), stageConvert, row, errors.New("data is not valid json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	letters, err := deadLetters.Load("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("Load() returned %d dead letters, want 2", len(letters))
+	}
+
+	for i, want := range []*JobEntry{valid, invalid} {
+		l := letters[i]
+		if !l.Replayable() || !json.Valid(l.Row) {
+			t.Errorf("%s: Replayable() = %v, row %s, want a replayable row shown as JSON", want.ID, l.Replayable(), l.Row)
+		}
+
+		// the row decodes with its data byte for byte, so a fixed
+		// conversion can replay it
+		row := new(JobEntry)
+		if err := decodeRow(l.Data, row); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(row, want) {
+			t.Errorf("%s: decoded %+v, want %+v", want.ID, row, want)
+		}
+	}
+}
+
+func TestReviveMappedRows(t *testing.T) {
+	useDeadLetterFile(t)
+
+	m := &Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"},
+		Columns: []*MappingColumn{
+			{Source: "id", Type: "string"},
+			{Source: "runs", Type: "int"},
+			{Source: "created_at", Type: "time", Null: "error"},
+			{Source: "note", Type: "string", Null: "keep"},
+		}}
+	d, err := m.definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// values as lib/pq returns them
+	src := &Row{"id": []byte("r1"), "runs": int64(1) << 60, "created_at": time.Date(2023, 5, 1, 12, 0, 0, 123456000, time.UTC), "note": nil}
+	want, err := d.Convert(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.reject(context.Background(), stageConvert, src, errors.New("schema mismatch")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.reject(context.Background(), stageInsert, want, errors.New("schema mismatch")); err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := deadLetters.Load("robots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("Load() returned %d dead letters, want 2", len(letters))
+	}
+	for _, l := range letters {
+		got, err := d.revive(l)
+		if err != nil {
+			t.Fatalf("revive(%s) = %v", l.Stage, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("revive(%s) = %#v, want %#v", l.Stage, *got, *want)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	useTestEnv(t, &fakeSource{})
+
+	var inserted [][]*testRow
+	d := testDefinition(&inserted)
+	rows := testRows(4, "bad0", "bad1", "drop2", "bad3")
+	for _, r := range rows {
+		if err := d.reject(context.Background(), stageConvert, r, errors.New("bad row")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.reject(context.Background(), stageInsert, &testRow{At: rows[0].At, ID: "r9"}, errors.New("rejected")); err != nil {
+		t.Fatal(err)
+	}
+
+	// bad1 still fails and drop2 is dropped, the others convert now
+	convert := d.Convert
+	d.Convert = func(r *testRow) (*testRow, error) {
+		if r.ID == "bad1" || strings.HasPrefix(r.ID, "drop") {
+			return convert(r)
+		}
+		return convert(&testRow{At: r.At, ID: "fixed-" + r.ID})
+	}
+	replayed, err := d.Replay(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, b := range inserted {
+		for _, r := range b {
+			got = append(got, r.ID)
+		}
+	}
+	if want := []string{"fixed-bad0", "fixed-bad3", "r9"}; replayed != 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay() = %d inserting %v, want 3 inserting %v", replayed, got, want)
+	}
+
+	left, err := deadLetters.Load("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || !strings.Contains(string(left[0].Row), "bad1") {
+		t.Errorf("dead letters left = %+v, want bad1 only", left)
+	}
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+
+	"clickhouse-migrations/config"
+)
+
+type dedupTokenKey struct{}
+
+// dedupWindow are the settings of tables written with deduplication
+// tokens. ClickHouse only remembers the tokens of the last inserts of
+// replicated tables by default; non replicated ones need a window, here
+// the last 1000 inserts, to drop an insert sent again.
+const dedupWindow = "non_replicated_deduplication_window = 1000"
+
+// dedupToken returns an insert_deduplication_token depending only on
+// parts, e.g. the table, run and key range of a batch. A batch inserted
+// again with the same token, after a timeout or by a run resuming from a
+// checkpoint older than the batch, is dropped by ClickHouse instead of
+// duplicated. Tokens of batches cut differently, by a resume with another
+// migration.batchsize or pagesize or rows converted this time that were
+// dead lettered before, do not match, so such batches are inserted again.
+func dedupToken(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// withDedupToken returns ctx carrying token for the inserts made with it,
+// unless insert.deduplicate is off.
+func withDedupToken(ctx context.Context, token string) context.Context {
+	if !config.Config.Insert.Deduplicate {
+		return ctx
+	}
+	return context.WithValue(ctx, dedupTokenKey{}, token)
+}
+
+// dedupPart derives the token of a part of a batch split by write from the
+// token in ctx, if any.
+func dedupPart(ctx context.Context, part string) context.Context {
+	token, ok := ctx.Value(dedupTokenKey{}).(string)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, dedupTokenKey{}, token+"."+part)
+}
+
+// dedupSettings returns ctx sending the token it carries, if any, as a
+// setting of the ClickHouse queries made with it, through GORM or natively.
+func dedupSettings(ctx context.Context) context.Context {
+	token, ok := ctx.Value(dedupTokenKey{}).(string)
+	if !ok {
+		return ctx
+	}
+	return clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"insert_deduplicate":         1,
+		"insert_deduplication_token": token,
+	}))
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"clickhouse-migrations/config"
+)
+
+func TestDedupToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  []string
+		equal bool
+	}{
+		{
+			name:  "same parts",
+			a:     []string{"jobs", "run", "2023-05", "a", "b"},
+			b:     []string{"jobs", "run", "2023-05", "a", "b"},
+			equal: true,
+		},
+		{
+			name: "other run",
+			a:    []string{"jobs", "run", "2023-05", "a", "b"},
+			b:    []string{"jobs", "other", "2023-05", "a", "b"},
+		},
+		{
+			name: "other batch end",
+			a:    []string{"jobs", "run", "2023-05", "a", "b"},
+			b:    []string{"jobs", "run", "2023-05", "a", "c"},
+		},
+		{
+			name: "parts joined differently",
+			a:    []string{"jobs", "ab"},
+			b:    []string{"jobsa", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := dedupToken(tt.a...), dedupToken(tt.b...)
+			if len(a) != 32 {
+				t.Errorf("dedupToken(%q) = %q, want 32 hex digits", tt.a, a)
+			}
+			if (a == b) != tt.equal {
+				t.Errorf("dedupToken(%q) = %q, dedupToken(%q) = %q, want equal %v", tt.a, a, tt.b, b, tt.equal)
+			}
+		})
+	}
+}
+
+func TestDedupPart(t *testing.T) {
+	config.Config = config.Default
+	defer func(deduplicate bool) { config.Config.Insert.Deduplicate = deduplicate }(config.Config.Insert.Deduplicate)
+
+	tests := []struct {
+		name        string
+		deduplicate bool
+		parts       []string
+		want        string
+		ok          bool
+	}{
+		{name: "batch", deduplicate: true, want: "t", ok: true},
+		{name: "half", deduplicate: true, parts: []string{"0"}, want: "t.0", ok: true},
+		{name: "quarter", deduplicate: true, parts: []string{"1", "0"}, want: "t.1.0", ok: true},
+		{name: "disabled", parts: []string{"0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.Insert.Deduplicate = tt.deduplicate
+			ctx := withDedupToken(context.Background(), "t")
+			for _, part := range tt.parts {
+				ctx = dedupPart(ctx, part)
+			}
+			got, ok := ctx.Value(dedupTokenKey{}).(string)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("token = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"clickhouse-migrations/config"
+)
+
+// Filter restricts migrations to the rows keyed in [Since, Until) of some
+// workspaces, for partial backfills. A zero time leaves that side open and
+// no Workspaces means every workspace.
+type Filter struct {
+	Since      time.Time
+	Until      time.Time
+	Workspaces []string
+}
+
+var filter Filter
+
+// ParseTime accepts a date or an RFC 3339 timestamp.
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, expected YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// InitFilter reads the filter from the since, until and workspace flags.
+func InitFilter() error {
+	var (
+		cfg = config.Config.Migration
+		err error
+	)
+
+	if cfg.Since != "" {
+		if filter.Since, err = ParseTime(cfg.Since); err != nil {
+			return err
+		}
+	}
+	if cfg.Until != "" {
+		if filter.Until, err = ParseTime(cfg.Until); err != nil {
+			return err
+		}
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && !filter.Since.Before(filter.Until) {
+		return fmt.Errorf("empty filter, since %s is not before until %s", cfg.Since, cfg.Until)
+	}
+
+	filter.Workspaces = append([]string(nil), cfg.Workspaces...)
+	sort.Strings(filter.Workspaces)
+
+	reportMu.Lock()
+	report.Filter = filter.String()
+	reportMu.Unlock()
+	return nil
+}
+
+func (f Filter) IsZero() bool {
+	return !f.timed() && len(f.Workspaces) == 0
+}
+
+func (f Filter) timed() bool {
+	return !f.Since.IsZero() || !f.Until.IsZero()
+}
+
+// String describes f in checkpoint names and the run report, empty when f
+// is zero.
+func (f Filter) String() string {
+	var parts []string
+	if !f.Since.IsZero() {
+		parts = append(parts, "since="+f.Since.UTC().Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		parts = append(parts, "until="+f.Until.UTC().Format(time.RFC3339))
+	}
+	if len(f.Workspaces) > 0 {
+		parts = append(parts, "workspace="+strings.Join(f.Workspaces, ","))
+	}
+	return strings.Join(parts, "&")
+}
+
+// checkpointName names the checkpoints of table under the filter, so a
+// partial backfill neither resumes from nor completes the ranges of a full
+// migration or of another filter.
+func checkpointName(table string) string {
+	if filter.IsZero() {
+		return table
+	}
+	return table + "?" + filter.String()
+}
+
+// restrict applies the filter to ranges, narrowing their key bounds and
+// dropping those left empty. Rows without a key timestamp are dropped by
+// any time filter.
+func (d *Definition[S, D]) restrict(ranges []*keyRange) ([]*keyRange, error) {
+	if len(filter.Workspaces) > 0 && d.Workspace == "" {
+		return nil, fmt.Errorf("%s has no workspace column to filter on", d.Table)
+	}
+
+	var restricted []*keyRange
+	for _, r := range ranges {
+		r := *r
+		if r.Null {
+			if filter.timed() {
+				continue
+			}
+		} else {
+			if !filter.Since.IsZero() && (r.From.IsZero() || r.From.Before(filter.Since)) {
+				r.From = filter.Since
+			}
+			if !filter.Until.IsZero() && (r.To.IsZero() || r.To.After(filter.Until)) {
+				r.To = filter.Until
+			}
+			if !r.From.IsZero() && !r.To.IsZero() && !r.From.Before(r.To) {
+				continue
+			}
+		}
+		if len(filter.Workspaces) > 0 {
+			r.Workspace, r.Workspaces = d.Workspace, filter.Workspaces
+		}
+		restricted = append(restricted, &r)
+	}
+	return restricted, nil
+}
+
+// count returns the number of source rows a migration copies: Count, or
+// the rows of the filtered ranges read without a limit.
+func (d *Definition[S, D]) count(ctx context.Context) (int64, error) {
+	var total int64
+	if filter.IsZero() {
+		err := db.Db.QueryRowContext(ctx, d.Count).Scan(&total)
+		return total, err
+	}
+
+	ranges, err := d.restrict([]*keyRange{{Name: "all"}, {Name: "null", Null: true}})
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range ranges {
+		var (
+			n           int64
+			where, args = r.where(d.KeyAt, d.KeyID, Key{})
+			query       = fmt.Sprintf("select count(*) from (%s) q", fmt.Sprintf(d.Query, where, math.MaxInt64))
+		)
+		if err := db.Db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// sourceFilter returns the filter as a Postgres condition over the key and
+// workspace columns and its arguments, or "" when the filter is zero. Like
+// verification, it leaves out rows without a key timestamp.
+func (d *Definition[S, D]) sourceFilter() (string, []interface{}, error) {
+	if filter.IsZero() {
+		return "", nil, nil
+	}
+
+	ranges, err := d.restrict([]*keyRange{{Name: "filter", From: filter.Since, To: filter.Until}})
+	if err != nil {
+		return "", nil, err
+	}
+	where, args := ranges[0].where(d.KeyAt, d.KeyID, Key{})
+	return where, args, nil
+}
+
+// destFilter returns the filter as a ClickHouse condition over the
+// destination key and workspace columns and its arguments, or "" when the
+// filter is zero.
+func (d *Definition[S, D]) destFilter() (string, []interface{}, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+
+	if !filter.Since.IsZero() {
+		conds = append(conds, d.DestKeyAt+" >= ?")
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, d.DestKeyAt+" < ?")
+		args = append(args, filter.Until)
+	}
+	if len(filter.Workspaces) > 0 {
+		if d.DestWorkspace == "" {
+			return "", nil, fmt.Errorf("%s has no workspace column to filter on", d.Table)
+		}
+		conds = append(conds, fmt.Sprintf("toString(%s) in ?", d.DestWorkspace))
+		args = append(args, filter.Workspaces)
+	}
+
+	return strings.Join(conds, " and "), args, nil
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	may  = time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	june = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	july = time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// withFilter sets the package filter to f until the test ends.
+func withFilter(t *testing.T, f Filter) {
+	filter = f
+	t.Cleanup(func() { filter = Filter{} })
+}
+
+func TestCheckpointName(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{name: "no filter", want: "jobs"},
+		{name: "since", filter: Filter{Since: may}, want: "jobs?since=2023-05-01T00:00:00Z"},
+		{name: "since and until", filter: Filter{Since: may, Until: june},
+			want: "jobs?since=2023-05-01T00:00:00Z&until=2023-06-01T00:00:00Z"},
+		{name: "workspaces", filter: Filter{Workspaces: []string{"w1", "w2"}}, want: "jobs?workspace=w1,w2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFilter(t, tt.filter)
+			if got := checkpointName("jobs"); got != tt.want {
+				t.Errorf("checkpointName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	d := &Definition[struct{}, struct{}]{Table: "jobs", Workspace: "workspace_id"}
+	ranges := []*keyRange{
+		{Name: "2023-04", To: may},
+		{Name: "2023-05", From: may, To: june},
+		{Name: "2023-06", From: june},
+		{Name: "null", Null: true},
+	}
+
+	tests := []struct {
+		name   string
+		def    *Definition[struct{}, struct{}]
+		filter Filter
+		want   []*keyRange
+		err    string
+	}{
+		{
+			name: "no filter",
+			want: ranges,
+		},
+		{
+			name:   "since",
+			filter: Filter{Since: june},
+			want:   []*keyRange{{Name: "2023-06", From: june}},
+		},
+		{
+			name:   "since and until",
+			filter: Filter{Since: may.AddDate(0, 0, 14), Until: july},
+			want: []*keyRange{
+				{Name: "2023-05", From: may.AddDate(0, 0, 14), To: june},
+				{Name: "2023-06", From: june, To: july},
+			},
+		},
+		{
+			name:   "workspaces",
+			filter: Filter{Workspaces: []string{"w1"}},
+			want: []*keyRange{
+				{Name: "2023-04", To: may, Workspace: "workspace_id", Workspaces: []string{"w1"}},
+				{Name: "2023-05", From: may, To: june, Workspace: "workspace_id", Workspaces: []string{"w1"}},
+				{Name: "2023-06", From: june, Workspace: "workspace_id", Workspaces: []string{"w1"}},
+				{Name: "null", Null: true, Workspace: "workspace_id", Workspaces: []string{"w1"}},
+			},
+		},
+		{
+			name:   "no workspace column",
+			def:    &Definition[struct{}, struct{}]{Table: "jobs"},
+			filter: Filter{Workspaces: []string{"w1"}},
+			err:    "no workspace column",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFilter(t, tt.filter)
+			def := tt.def
+			if def == nil {
+				def = d
+			}
+
+			got, err := def.restrict(ranges)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("restrict() error = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("restrict() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restrict() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDestFilter(t *testing.T) {
+	d := &Definition[struct{}, struct{}]{Table: "jobs", DestKeyAt: "run_at", DestWorkspace: "workspace_id"}
+
+	tests := []struct {
+		name   string
+		def    *Definition[struct{}, struct{}]
+		filter Filter
+		where  string
+		args   []interface{}
+		err    string
+	}{
+		{name: "no filter"},
+		{
+			name:   "since and until",
+			filter: Filter{Since: may, Until: june},
+			where:  "run_at >= ? and run_at < ?",
+			args:   []interface{}{may, june},
+		},
+		{
+			name:   "workspaces",
+			filter: Filter{Until: june, Workspaces: []string{"w1", "w2"}},
+			where:  "run_at < ? and toString(workspace_id) in ?",
+			args:   []interface{}{june, []string{"w1", "w2"}},
+		},
+		{
+			name:   "no workspace column",
+			def:    &Definition[struct{}, struct{}]{Table: "jobs", DestKeyAt: "run_at"},
+			filter: Filter{Workspaces: []string{"w1"}},
+			err:    "no workspace column",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFilter(t, tt.filter)
+			def := tt.def
+			if def == nil {
+				def = d
+			}
+
+			where, args, err := def.destFilter()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("destFilter() error = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("destFilter() error = %v", err)
+			}
+			if where != tt.where || !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("destFilter() = %q, %v, want %q, %v", where, args, tt.where, tt.args)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse-migrations/config"
+)
+
+func TestIncrement(t *testing.T) {
+	var (
+		source = testRows(10, "", "bad1")
+		now    = time.Date(2023, 5, 2, 0, 0, 0, 0, time.UTC)
+	)
+
+	tests := []struct {
+		name      string
+		watermark string
+		rows      int64
+		inserted  []string
+	}{
+		{name: "first run copies every row", inserted: ids(source, 0, 10)},
+		{
+			name:      "rows changed since the watermark less overlap",
+			watermark: source[6].At.Add(time.Second).Format(time.RFC3339Nano),
+			rows:      100,
+			inserted:  ids(source, 5, 10),
+		},
+		{
+			name:      "nothing changed",
+			watermark: now.Format(time.RFC3339Nano),
+			rows:      100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestEnv(t, &fakeSource{rows: source, now: now})
+			if tt.watermark != "" {
+				cp := &Checkpoint{RunID: "earlier", Table: incrementalCheckpoint, Range: "test", LastKey: tt.watermark, Rows: tt.rows, Done: true}
+				if err := saveCheckpoint(cp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var inserted [][]*testRow
+			copied, err := testDefinition(&inserted).Increment(context.Background(), 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, b := range inserted {
+				for _, r := range b {
+					got = append(got, r.ID)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.inserted) {
+				t.Errorf("inserted %v, want %v", got, tt.inserted)
+			}
+			if copied != int64(len(tt.inserted)) {
+				t.Errorf("Increment() = %d, want %d", copied, len(tt.inserted))
+			}
+
+			cp, err := loadWatermark("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := now.Format(time.RFC3339Nano); cp.LastKey != want || !cp.Done || cp.RunID != runID {
+				t.Errorf("watermark = %+v, want %s saved by this run", cp, want)
+			}
+			if want := tt.rows + copied; cp.Rows != want {
+				t.Errorf("watermark counts %d rows, want %d", cp.Rows, want)
+			}
+		})
+	}
+}
+
+func TestIncrementFailure(t *testing.T) {
+	t.Run("invalid watermark", func(t *testing.T) {
+		useTestEnv(t, &fakeSource{rows: testRows(3)})
+		if err := saveCheckpoint(&Checkpoint{Table: incrementalCheckpoint, Range: "test", LastKey: "yesterday"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testDefinition(nil).Increment(context.Background(), 0); err == nil || !strings.Contains(err.Error(), "Invalid test watermark") {
+			t.Errorf("Increment() = %v, want the watermark rejected", err)
+		}
+	})
+
+	t.Run("failed insert keeps the watermark", func(t *testing.T) {
+		useTestEnv(t, &fakeSource{rows: testRows(3), now: time.Date(2023, 5, 2, 0, 0, 0, 0, time.UTC)})
+		watermark := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339Nano)
+		if err := saveCheckpoint(&Checkpoint{Table: incrementalCheckpoint, Range: "test", LastKey: watermark, Done: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		config.Config.Retry.Attempts = 1
+
+		d := testDefinition(nil)
+		d.Insert = func(ctx context.Context, rows []*testRow) error { return driver.ErrBadConn }
+		if _, err := d.Increment(context.Background(), 0); err == nil {
+			t.Fatal("Increment() succeeded, want the insert error")
+		}
+
+		cp, err := loadWatermark("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp.LastKey != watermark {
+			t.Errorf("watermark = %s, want %s kept for the next run", cp.LastKey, watermark)
+		}
+	})
+}
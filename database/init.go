@@ -1,16 +1,17 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"time"
 
 	_ "github.com/lib/pq"
 	gorp "gopkg.in/gorp.v1"
 	"gorm.io/driver/clickhouse"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 
 	"clickhouse-migrations/config"
 )
@@ -20,7 +21,7 @@ var (
 	db *gorp.DbMap
 )
 
-func InitDB() error {
+func InitDB(ctx context.Context) error {
 
 	var (
 		cfg         = config.Config
@@ -47,8 +48,8 @@ func InitDB() error {
 	conn.SetMaxOpenConns(maxOpen)
 	conn.SetConnMaxLifetime(time.Duration(maxLifetime) * time.Second)
 
-	if err = conn.Ping(); err != nil {
-		return fmt.Errorf("Database connection error: %s", err.Error())
+	if err = conn.PingContext(ctx); err != nil {
+		return fmt.Errorf("Database connection error: %w", err)
 	}
 
 	db = &gorp.DbMap{Db: conn, Dialect: gorp.PostgresDialect{}}
@@ -56,13 +57,13 @@ func InitDB() error {
 	db.AddTableWithNameAndSchema(JobPG{}, "workspace", "jobs").SetKeys(true, "id")
 
 	if debug {
-		db.TraceOn("[gorp]", log.New(os.Stdout, "myapp:", log.Lmicroseconds))
+		db.TraceOn("", queryLogger{source: "gorp", level: slog.LevelDebug})
 	}
 
 	return nil
 }
 
-func InitClickHouse() error {
+func InitClickHouse(ctx context.Context) error {
 	var (
 		cfg = config.Config
 		err error
@@ -77,12 +78,23 @@ func InitClickHouse() error {
 		cfg.ClickHouse.Name,
 	)
 
-	ch, err = gorm.Open(clickhouse.Open(dsn), &gorm.Config{})
+	ch, err = gorm.Open(clickhouse.Open(dsn), &gorm.Config{
+		Logger: logger.New(queryLogger{source: "gorm", level: slog.LevelWarn}, logger.Config{
+			SlowThreshold:             200 * time.Millisecond,
+			LogLevel:                  logger.Warn,
+			IgnoreRecordNotFoundError: true,
+		}),
+	})
 	if err != nil {
 		return err
 	}
 
-	//MigrateJobs()
-
-	return nil
+	conn, err := ch.DB()
+	if err != nil {
+		return err
+	}
+	if err := conn.PingContext(ctx); err != nil {
+		return err
+	}
+	return openNative(ctx)
 }
@@ -1,7 +1,10 @@
 package database
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -43,15 +46,36 @@ func (j *Job) Insert() error {
 }
 
 func (j *Job) Update() error {
-	j.UpdatedAt = time.Now()
+	j.touch(time.Now())
 	return ch.Create(j).Error
 }
 
 func (j *Job) Delete() (*Job, error) {
-	now := time.Now()
+	j.markDeleted(time.Now())
+	return j, ch.Create(j).Error
+}
+
+// touch and markDeleted version j the way Update and Delete do without
+// writing it, so many versions can be inserted in one batch. The engine
+// keeps the row with the greatest updated_at, so both move it past the
+// version they replace even when now is not later.
+func (j *Job) touch(now time.Time) {
+	j.UpdatedAt = nextVersion(j.UpdatedAt, now)
+}
+
+func (j *Job) markDeleted(now time.Time) {
+	j.UpdatedAt = nextVersion(j.UpdatedAt, now)
 	j.IsDeleted = true
 	j.DeletedAt = &now
-	return j, ch.Create(j).Error
+}
+
+// nextVersion returns now, or the millisecond after prev when now is not
+// later at the millisecond precision of updated_at.
+func nextVersion(prev, now time.Time) time.Time {
+	if now.Truncate(time.Millisecond).After(prev.Truncate(time.Millisecond)) {
+		return now
+	}
+	return prev.Truncate(time.Millisecond).Add(time.Millisecond)
 }
 
 type JobPG struct {
@@ -75,67 +99,167 @@ type JobEntry struct {
 	VersionName *string `db:"version_name" json:"version_name"`
 }
 
-func MigrateJobs() {
-	var (
-		size = 3_000_000
-		page = 1
-	)
-
-	for {
-		var (
-			jobs   []*JobEntry
-			chJobs = []*Job{}
-		)
-
-		query := `select r."name" as robot_name, COALESCE(f."name", 'Untitled') as flow_name, j."id", j.robot_id, j.workspace_id,
+const jobsQuery = `select r."name" as robot_name, COALESCE(f."name", 'Untitled') as flow_name, j."id", j.robot_id, j.workspace_id,
 		j.flow_id, j.published_flow_id, j.robot_type, j.run_at, j.running_time, j.status, j.stopped_at, j."data", 
 		fv."name" as version_name from workspace.jobs j 
 		inner join workspace.robots r on j.robot_id = r.id
 		left join workspace.flows f on j.flow_id = f.id 
 		left join workspace.published_flows pf on pf.id = j.published_flow_id 
 		left join workspace.flows_versions fv on fv.id = version_id 
-		order by run_at desc offset $1 rows fetch next $2 rows only`
+		where %s order by j.run_at, j.id limit %d`
 
-		if _, err := db.Select(&jobs, query, (page-1)*size, size); err != nil {
-			log.Println("Migrate jobs failed:", err)
-			return
-		}
+// scanJobEntry scans a row selected by jobsQuery.
+func scanJobEntry(rows *sql.Rows) (*JobEntry, error) {
+	j := &JobEntry{}
+	err := rows.Scan(&j.RobotName, &j.FlowName, &j.ID, &j.RobotID, &j.WorkspaceID,
+		&j.FlowID, &j.PublishedFlowID, &j.RobotType, &j.RunAt, &j.RunningTime, &j.Status, &j.StoppedAt, &j.Data,
+		&j.VersionName)
+	return j, err
+}
 
-		for _, j := range jobs {
-			chJobs = append(chJobs, &Job{
-				ID:              j.ID,
-				RobotID:         j.RobotID,
-				WorkspaceID:     j.WorkspaceID,
-				FlowID:          j.FlowID,
-				PublishedFlowID: j.PublishedFlowID,
-				RobotType:       int64(j.RobotType),
-				RunAt:           j.RunAt.ValueOrZero(),
-				StoppedAt:       j.StoppedAt.Ptr(),
-				RunningTime:     j.RunningTime,
-				Status:          j.Status,
-				Data:            string(j.Data),
-				RobotName:       j.RobotName,
-				FlowName:        j.FlowName,
-				VersionName:     j.VersionName,
-				CreatedAt:       j.RunAt.Time,
-				UpdatedAt:       j.RunAt.Time,
-				IsDeleted:       false,
-				DeletedAt:       nil,
-			})
-		}
+func (j *JobEntry) Job() *Job {
+	return &Job{
+		ID:              j.ID,
+		RobotID:         j.RobotID,
+		WorkspaceID:     j.WorkspaceID,
+		FlowID:          j.FlowID,
+		PublishedFlowID: j.PublishedFlowID,
+		RobotType:       int64(j.RobotType),
+		RunAt:           j.RunAt.ValueOrZero(),
+		StoppedAt:       j.StoppedAt.Ptr(),
+		RunningTime:     j.RunningTime,
+		Status:          j.Status,
+		Data:            string(j.Data),
+		RobotName:       j.RobotName,
+		FlowName:        j.FlowName,
+		VersionName:     j.VersionName,
+		CreatedAt:       j.RunAt.Time,
+		UpdatedAt:       j.RunAt.Time,
+		IsDeleted:       false,
+		DeletedAt:       nil,
+	}
+}
 
-		if len(chJobs) == 0 {
-			log.Println("Migration completed")
-			return
-		}
+var JobsSchema = &TableSchema{
+	Name:    "jobs",
+	Version: 2,
+	Columns: []*ColumnSchema{
+		{Name: "id", Type: "String"},
+		{Name: "robot_id", Type: "String"},
+		{Name: "workspace_id", Type: "String"},
+		{Name: "flow_id", Type: "Nullable(String)"},
+		{Name: "published_flow_id", Type: "Nullable(String)"},
+		{Name: "robot_type", Type: "Int64"},
+		{Name: "run_at", Type: "DateTime64(3)", Codec: "Delta(8), ZSTD(1)"},
+		{Name: "stopped_at", Type: "Nullable(DateTime64(3))"},
+		{Name: "running_time", Type: "Int64"},
+		{Name: "status", Type: "LowCardinality(String)"},
+		{Name: "data", Type: "String", Codec: "ZSTD(3)"},
+		{Name: "robot_name", Type: "String"},
+		{Name: "flow_name", Type: "String"},
+		{Name: "version_name", Type: "Nullable(String)"},
+		{Name: "created_at", Type: "DateTime64(3)"},
+		{Name: "updated_at", Type: "DateTime64(3)"},
+		{Name: "is_deleted", Type: "Bool"},
+		{Name: "deleted_at", Type: "Nullable(DateTime64(3))"},
+	},
+	// Update and Delete insert a new version of the row, collapsed on
+	// updated_at by the engine.
+	Engine:      "ReplacingMergeTree(updated_at)",
+	PartitionBy: "toYYYYMM(run_at)",
+	OrderBy:     "(workspace_id, id)",
+	Settings:    dedupWindow,
+}
 
-		err := ch.Create(chJobs).Error
-		if err != nil {
-			log.Println("Migrate jobs failed on create", err)
-			return
-		}
+var jobColumns = []string{"id", "robot_id", "workspace_id", "flow_id", "published_flow_id", "robot_type",
+	"run_at", "stopped_at", "running_time", "status", "data", "robot_name", "flow_name", "version_name",
+	"created_at", "updated_at", "is_deleted", "deleted_at"}
 
-		log.Println("Migration page:", page)
-		page++
+// jobValues returns the jobColumns of jobs for the native writer.
+func jobValues(jobs []*Job) []interface{} {
+	var (
+		n               = len(jobs)
+		id              = make([]string, n)
+		robotID         = make([]string, n)
+		workspaceID     = make([]string, n)
+		flowID          = make([]*string, n)
+		publishedFlowID = make([]*string, n)
+		robotType       = make([]int64, n)
+		runAt           = make([]time.Time, n)
+		stoppedAt       = make([]*time.Time, n)
+		runningTime     = make([]int64, n)
+		status          = make([]string, n)
+		data            = make([]string, n)
+		robotName       = make([]string, n)
+		flowName        = make([]string, n)
+		versionName     = make([]*string, n)
+		createdAt       = make([]time.Time, n)
+		updatedAt       = make([]time.Time, n)
+		isDeleted       = make([]bool, n)
+		deletedAt       = make([]*time.Time, n)
+	)
+	for i, j := range jobs {
+		id[i], robotID[i], workspaceID[i] = j.ID, j.RobotID, j.WorkspaceID
+		flowID[i], publishedFlowID[i] = j.FlowID, j.PublishedFlowID
+		robotType[i], runAt[i], stoppedAt[i], runningTime[i] = j.RobotType, j.RunAt, j.StoppedAt, j.RunningTime
+		status[i], data[i] = j.Status, j.Data
+		robotName[i], flowName[i], versionName[i] = j.RobotName, j.FlowName, j.VersionName
+		createdAt[i], updatedAt[i] = j.CreatedAt, j.UpdatedAt
+		isDeleted[i], deletedAt[i] = j.IsDeleted, j.DeletedAt
 	}
+	return []interface{}{id, robotID, workspaceID, flowID, publishedFlowID, robotType,
+		runAt, stoppedAt, runningTime, status, data, robotName, flowName, versionName,
+		createdAt, updatedAt, isDeleted, deletedAt}
+}
+
+// jobsVerification reads workspace.jobs without the joins of jobsQuery, so
+// jobs dropped by them show up as missing. Jobs without run_at are not
+// partitioned and left out on both sides.
+var jobsVerification = &Verification{
+	Source: `select floor(extract(epoch from j.run_at) / 86400)::bigint as day, j.workspace_id::text, count(*) as row_count,
+		` + pgHash(`j.id::text || '|' || coalesce(j.status, '') || '|' || coalesce(j.running_time, 0) || '|' ||
+			floor(extract(epoch from j.run_at))::bigint || '|' || coalesce(floor(extract(epoch from j.stopped_at))::bigint, 0)`) + ` as hash
+		from workspace.jobs j where j.run_at is not null%s group by 1, 2`,
+	Destination: `select intDiv(toUnixTimestamp64Milli(run_at), 86400000) as day, workspace_id, count() as row_count,
+		` + chHash(`concat(id, '|', status, '|', toString(running_time), '|',
+			toString(intDiv(toUnixTimestamp64Milli(run_at), 1000)), '|', toString(ifNull(intDiv(toUnixTimestamp64Milli(stopped_at), 1000), 0)))`) + ` as hash
+		from jobs final where not is_deleted and run_at > toDateTime64(0, 3)%s group by day, workspace_id`,
+}
+
+var JobsMigration = &Definition[JobEntry, Job]{
+	Table:         "jobs",
+	Destination:   "jobs",
+	DestKeyAt:     "run_at",
+	DestKeyID:     "id",
+	Source:        "workspace.jobs",
+	Query:         jobsQuery,
+	KeyAt:         "j.run_at",
+	KeyID:         "j.id",
+	Workspace:     "j.workspace_id",
+	DestWorkspace: "workspace_id",
+	DestDeleted:   "is_deleted",
+	Changed:       []string{"j.run_at", "j.stopped_at"},
+	Bounds:        `select min(run_at), max(run_at) from workspace.jobs`,
+	Count: `select count(*) from workspace.jobs j
+		inner join workspace.robots r on j.robot_id = r.id`,
+	Verification: jobsVerification,
+	Columns:      jobColumns,
+	Values:       jobValues,
+	Scan:         scanJobEntry,
+	Key: func(j *JobEntry) (null.Time, string) {
+		return j.RunAt, j.ID
+	},
+	Convert: func(j *JobEntry) (*Job, error) {
+		switch {
+		case !j.RunAt.Valid:
+			return nil, fmt.Errorf("run_at is null")
+		case len(j.Data) > 0 && !json.Valid(j.Data):
+			return nil, fmt.Errorf("data is not valid json")
+		}
+		return j.Job(), nil
+	},
+}
+
+func MigrateJobs(ctx context.Context) error {
+	return JobsMigration.Migrate(ctx)
 }
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	null "gopkg.in/guregu/null.v3"
+)
+
+// Key is a position in a (timestamp, id) keyset ordering. The zero Key is
+// the start of a range.
+type Key struct {
+	At time.Time `json:"at"`
+	ID string    `json:"id"`
+}
+
+func parseKey(s string) (Key, error) {
+	var k Key
+	if s == "" {
+		return k, nil
+	}
+	err := json.Unmarshal([]byte(s), &k)
+	return k, err
+}
+
+func (k Key) String() string {
+	data, _ := json.Marshal(k)
+	return string(data)
+}
+
+// keyOf returns the key of a row whose timestamp is at and id is id.
+func keyOf(at null.Time, id string) Key {
+	return Key{At: at.ValueOrZero(), ID: id}
+}
+
+// keyRange is a slice of a table by its key timestamp. A zero From or To
+// leaves that side open. Rows whose timestamp is null live in their own
+// range with Null set, paged by id only. Splitting them out keeps every
+// page an index range scan on (timestamp, id). A non empty Changed further
+// restricts the range to rows where any of those columns is at or after
+// Since, and non empty Workspaces to rows whose Workspace column is one of
+// them.
+type keyRange struct {
+	Name       string
+	From       time.Time
+	To         time.Time
+	Null       bool
+	Changed    []string
+	Since      time.Time
+	Workspace  string
+	Workspaces []string
+}
+
+// where returns a predicate over the timestamp column atCol and the id
+// column idCol selecting the rows of r strictly after k.
+func (r *keyRange) where(atCol, idCol string, k Key) (string, []interface{}) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	switch {
+	case r.Null:
+		conds = append(conds, atCol+" is null")
+		if k.ID != "" {
+			conds = append(conds, fmt.Sprintf("%s > %s", idCol, arg(k.ID)))
+		}
+	case k.ID != "":
+		conds = append(conds, fmt.Sprintf("(%s, %s) > (%s, %s)", atCol, idCol, arg(k.At), arg(k.ID)))
+	case !r.From.IsZero():
+		conds = append(conds, fmt.Sprintf("%s >= %s", atCol, arg(r.From)))
+	default:
+		conds = append(conds, atCol+" is not null")
+	}
+	if !r.Null && !r.To.IsZero() {
+		conds = append(conds, fmt.Sprintf("%s < %s", atCol, arg(r.To)))
+	}
+	if len(r.Changed) > 0 {
+		var (
+			since   = arg(r.Since)
+			changed = make([]string, len(r.Changed))
+		)
+		for i, c := range r.Changed {
+			changed[i] = fmt.Sprintf("%s >= %s", c, since)
+		}
+		conds = append(conds, "("+strings.Join(changed, " or ")+")")
+	}
+	if len(r.Workspaces) > 0 {
+		conds = append(conds, fmt.Sprintf("%s::text = any(%s)", r.Workspace, arg(pq.Array(r.Workspaces))))
+	}
+	return strings.Join(conds, " and "), args
+}
+
+// splitRanges cuts [min, max] into ranges of one partition unit ("month",
+// "day" or "none" for a single range). The first and last ranges are left
+// open so rows outside the bounds seen at planning time are not lost. A
+// range for null timestamps is always appended.
+func splitRanges(min, max null.Time, partition string) ([]*keyRange, error) {
+	var (
+		ranges []*keyRange
+		trunc  func(t time.Time) time.Time
+		next   func(t time.Time) time.Time
+		layout string
+	)
+
+	switch partition {
+	case "month":
+		layout = "2006-01"
+		trunc = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) }
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	case "day":
+		layout = "2006-01-02"
+		trunc = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC) }
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case "none":
+	default:
+		return nil, fmt.Errorf("unknown partition %q, expected month, day or none", partition)
+	}
+
+	if trunc == nil || !min.Valid || !max.Valid {
+		ranges = append(ranges, &keyRange{Name: "all"})
+	} else {
+		last := trunc(max.Time.UTC())
+		for from := trunc(min.Time.UTC()); !from.After(last); from = next(from) {
+			r := &keyRange{Name: from.Format(layout), From: from, To: next(from)}
+			ranges = append(ranges, r)
+		}
+		ranges[0].From = time.Time{}
+		ranges[len(ranges)-1].To = time.Time{}
+	}
+
+	return append(ranges, &keyRange{Name: "null", Null: true}), nil
+}
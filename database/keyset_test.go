@@ -0,0 +1,170 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestKeyRangeWhere(t *testing.T) {
+	var (
+		from  = time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+		to    = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+		since = time.Date(2023, 5, 15, 0, 0, 0, 0, time.UTC)
+		key   = Key{At: time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC), ID: "a"}
+	)
+
+	tests := []struct {
+		name  string
+		r     keyRange
+		key   Key
+		where string
+		args  []interface{}
+	}{
+		{
+			name:  "open range",
+			where: "run_at is not null",
+		},
+		{
+			name:  "first page",
+			r:     keyRange{From: from, To: to},
+			where: "run_at >= $1 and run_at < $2",
+			args:  []interface{}{from, to},
+		},
+		{
+			name:  "after key",
+			r:     keyRange{From: from, To: to},
+			key:   key,
+			where: "(run_at, id) > ($1, $2) and run_at < $3",
+			args:  []interface{}{key.At, key.ID, to},
+		},
+		{
+			name:  "null first page",
+			r:     keyRange{Null: true, To: to},
+			where: "run_at is null",
+		},
+		{
+			name:  "null after key",
+			r:     keyRange{Null: true},
+			key:   Key{ID: "a"},
+			where: "run_at is null and id > $1",
+			args:  []interface{}{"a"},
+		},
+		{
+			name:  "changed",
+			r:     keyRange{Changed: []string{"run_at", "stopped_at"}, Since: since},
+			where: "run_at is not null and (run_at >= $1 or stopped_at >= $1)",
+			args:  []interface{}{since},
+		},
+		{
+			name:  "workspaces",
+			r:     keyRange{To: to, Workspace: "workspace_id", Workspaces: []string{"w1", "w2"}},
+			where: "run_at is not null and run_at < $1 and workspace_id::text = any($2)",
+			args:  []interface{}{to, pq.Array([]string{"w1", "w2"})},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := tt.r.where("run_at", "id", tt.key)
+			if where != tt.where {
+				t.Errorf("where() = %q, want %q", where, tt.where)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("where() args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	var (
+		min = null.TimeFrom(time.Date(2023, 3, 15, 10, 0, 0, 0, time.UTC))
+		max = null.TimeFrom(time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC))
+	)
+
+	tests := []struct {
+		name      string
+		min, max  null.Time
+		partition string
+		names     []string
+		err       string
+	}{
+		{name: "months", min: min, max: max, partition: "month", names: []string{"2023-03", "2023-04", "2023-05", "null"}},
+		{name: "one month", min: min, max: min, partition: "month", names: []string{"2023-03", "null"}},
+		{name: "days", min: max, max: null.TimeFrom(max.Time.AddDate(0, 0, 2)), partition: "day",
+			names: []string{"2023-05-02", "2023-05-03", "2023-05-04", "null"}},
+		{name: "none", min: min, max: max, partition: "none", names: []string{"all", "null"}},
+		{name: "empty table", partition: "month", names: []string{"all", "null"}},
+		{name: "unknown partition", min: min, max: max, partition: "week", err: "unknown partition"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := splitRanges(tt.min, tt.max, tt.partition)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("splitRanges() error = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitRanges() error = %v", err)
+			}
+
+			var names []string
+			for _, r := range ranges {
+				names = append(names, r.Name)
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Fatalf("splitRanges() = %v, want %v", names, tt.names)
+			}
+
+			// the outer ranges are open and the inner ones adjacent
+			dated := ranges[:len(ranges)-1]
+			if !dated[0].From.IsZero() || !dated[len(dated)-1].To.IsZero() {
+				t.Errorf("outer ranges %+v and %+v are not open", dated[0], dated[len(dated)-1])
+			}
+			for i := 1; i < len(dated); i++ {
+				if !dated[i].From.Equal(dated[i-1].To) {
+					t.Errorf("range %s starts at %s, not where %s ends at %s", dated[i].Name, dated[i].From, dated[i-1].Name, dated[i-1].To)
+				}
+			}
+			if !ranges[len(ranges)-1].Null {
+				t.Errorf("last range %+v is not the null range", ranges[len(ranges)-1])
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	at := time.Date(2023, 5, 1, 10, 0, 0, 123_000_000, time.UTC)
+
+	tests := []struct {
+		name string
+		s    string
+		want Key
+		err  bool
+	}{
+		{name: "empty", s: ""},
+		{name: "round trip", s: Key{At: at, ID: "a"}.String(), want: Key{At: at, ID: "a"}},
+		{name: "null timestamp", s: keyOf(null.Time{}, "a").String(), want: Key{ID: "a"}},
+		{name: "invalid", s: "2023-05-01", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKey(tt.s)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseKey(%q) error = %v, want error %v", tt.s, err, tt.err)
+			}
+			if !tt.err && (!got.At.Equal(tt.want.At) || got.ID != tt.want.ID) {
+				t.Errorf("parseKey(%q) = %+v, want %+v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"clickhouse-migrations/config"
+)
+
+// The ledger is a pair of append only ClickHouse tables. Runs holds a row
+// when a writing command starts and another with its outcome when it ends,
+// collapsed on updated_at. Batches holds a row for every batch written or
+// failed, with the run that wrote it, the range run whose deduplication
+// tokens it used and its key bounds, so history can be queried with plain
+// SQL, e.g. which run wrote a job:
+//
+//	select run_id from migration_batches
+//	where table_name = 'jobs' and status = 'written'
+//	  and after_at <= '2023-05-01 10:00:00' and last_at >= '2023-05-01 10:00:00'
+type ledgerTables struct {
+	runs    string
+	batches string
+}
+
+// ledger is nil when the ledger is disabled or neither initialized nor
+// opened, e.g. in a dry run, and ledgerRun nil unless this run is recorded.
+var (
+	ledger    *ledgerTables
+	ledgerRun *LedgerRun
+)
+
+// LedgerRun is a row of the runs table.
+type LedgerRun struct {
+	RunID      string
+	Command    string
+	Filter     string
+	Status     string
+	Error      string
+	Rows       int64
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	UpdatedAt  time.Time
+}
+
+// LedgerBatch is a row of the batches table. Rows were read from the
+// source for the batch, Written the ones inserted; the difference was
+// dropped by the conversion or dead lettered.
+type LedgerBatch struct {
+	RunID      string
+	Table      string
+	Checkpoint string
+	Range      string
+	RangeRunID string
+	Page       int
+	AfterKey   string
+	LastKey    string
+	AfterAt    time.Time
+	LastAt     time.Time
+	Rows       int64
+	Written    int64
+	Hash       string
+	Token      string
+	Status     string
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// LedgerSummary totals the batches of one table and status in a run.
+type LedgerSummary struct {
+	Table   string
+	Status  string
+	Batches int64
+	Rows    int64
+	Written int64
+}
+
+// InitLedger creates the ledger tables selected in the config, for the
+// commands writing to them. It has to be called after InitClickHouse.
+func InitLedger(ctx context.Context) error {
+	cfg := config.Config.Ledger
+	if !cfg.Enabled {
+		return nil
+	}
+
+	err := ch.WithContext(ctx).Exec(fmt.Sprintf(`create table if not exists %s (
+		run_id String,
+		command String,
+		filter String,
+		status LowCardinality(String),
+		error String,
+		rows Int64,
+		started_at DateTime64(3),
+		finished_at Nullable(DateTime64(3)),
+		updated_at DateTime64(3)
+	) engine = ReplacingMergeTree(updated_at) order by run_id`, cfg.Runs)).Error
+	if err != nil {
+		return fmt.Errorf("Ledger error: %s", err.Error())
+	}
+
+	err = ch.WithContext(ctx).Exec(fmt.Sprintf(`create table if not exists %s (
+		run_id String,
+		table_name LowCardinality(String),
+		checkpoint String,
+		range_name String,
+		range_run_id String,
+		page UInt32,
+		after_key String,
+		last_key String,
+		after_at DateTime64(3),
+		last_at DateTime64(3),
+		rows Int64,
+		written Int64,
+		hash String,
+		token String,
+		status LowCardinality(String),
+		error String,
+		started_at DateTime64(3),
+		finished_at DateTime64(3)
+	) engine = MergeTree partition by toYYYYMM(started_at) order by (table_name, run_id, started_at)
+	settings %s`, cfg.Batches, dedupWindow)).Error
+	if err != nil {
+		return fmt.Errorf("Ledger error: %s", err.Error())
+	}
+
+	ledger = &ledgerTables{runs: cfg.Runs, batches: cfg.Batches}
+	return nil
+}
+
+// OpenLedger selects the ledger tables for reading without creating them,
+// so commands only reading the ledger leave ClickHouse untouched. It
+// returns an error if the ledger is disabled or no run created its tables.
+func OpenLedger(ctx context.Context) error {
+	cfg := config.Config.Ledger
+	if !cfg.Enabled {
+		return fmt.Errorf("Ledger is disabled")
+	}
+
+	var names []string
+	err := ch.WithContext(ctx).Raw(`select name from system.tables
+		where database = currentDatabase() and name in (?, ?)`, cfg.Runs, cfg.Batches).Scan(&names).Error
+	if err != nil {
+		return fmt.Errorf("Ledger error: %s", err.Error())
+	}
+	if len(names) < 2 {
+		return fmt.Errorf("Ledger tables %s and %s do not exist, no run has been recorded yet", cfg.Runs, cfg.Batches)
+	}
+
+	ledger = &ledgerTables{runs: cfg.Runs, batches: cfg.Batches}
+	return nil
+}
+
+// StartLedgerRun records this run as running. It has to be called after
+// InitLedger and InitFilter.
+func StartLedgerRun(ctx context.Context, command []string) error {
+	if ledger == nil {
+		return nil
+	}
+
+	reportMu.Lock()
+	ledgerRun = &LedgerRun{
+		RunID:     runID,
+		Command:   strings.Join(command, " "),
+		Filter:    report.Filter,
+		Status:    "running",
+		StartedAt: report.StartedAt,
+	}
+	reportMu.Unlock()
+
+	if err := ledger.saveRun(ctx, ledgerRun); err != nil {
+		return fmt.Errorf("Ledger error: %s", err.Error())
+	}
+	return nil
+}
+
+// FinishLedgerRun records the outcome of a run started with
+// StartLedgerRun and the rows it inserted.
+func FinishLedgerRun(ctx context.Context, err error, interrupted bool) error {
+	if ledger == nil || ledgerRun == nil {
+		return nil
+	}
+
+	now := time.Now()
+	ledgerRun.Status = runStatus(err, interrupted)
+	ledgerRun.FinishedAt = &now
+	if err != nil {
+		ledgerRun.Error = err.Error()
+	}
+
+	reportMu.Lock()
+	for _, t := range report.Tables {
+		ledgerRun.Rows += t.Rows
+	}
+	reportMu.Unlock()
+
+	return ledger.saveRun(context.WithoutCancel(ctx), ledgerRun)
+}
+
+func (l *ledgerTables) saveRun(ctx context.Context, run *LedgerRun) error {
+	run.UpdatedAt = time.Now()
+	return Retry(ctx, "Ledger run insert", func() error {
+		return ch.WithContext(ctx).Exec(fmt.Sprintf(`insert into %s (run_id, command, filter, status, error, rows,
+			started_at, finished_at, updated_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`, l.runs),
+			run.RunID, run.Command, run.Filter, run.Status, run.Error, run.Rows,
+			run.StartedAt, run.FinishedAt, run.UpdatedAt).Error
+	})
+}
+
+// ledgerEntry returns the ledger row of the page-th batch of r, read after
+// key by run with the deduplication token, or nil without a ledger.
+func (d *Definition[S, D]) ledgerEntry(run string, r *keyRange, page int, after Key, b *batch[D], token string) *LedgerBatch {
+	if ledger == nil {
+		return nil
+	}
+	return &LedgerBatch{
+		RunID:      runID,
+		Table:      d.Table,
+		Checkpoint: checkpointName(d.Table),
+		Range:      r.Name,
+		RangeRunID: run,
+		Page:       page,
+		AfterKey:   after.String(),
+		LastKey:    b.last.String(),
+		AfterAt:    after.At,
+		LastAt:     b.last.At,
+		Rows:       int64(b.read),
+		Hash:       contentHash(b.rows),
+		Token:      token,
+		StartedAt:  time.Now(),
+	}
+}
+
+// record inserts e as written, or failed with cause. A token derived from
+// the batch's keeps a retried ledger insert from recording it twice. A nil
+// e records nothing.
+func (e *LedgerBatch) record(ctx context.Context, written int, cause error) error {
+	if e == nil {
+		return nil
+	}
+
+	e.Written, e.FinishedAt = int64(written), time.Now()
+	e.Status = "written"
+	if cause != nil {
+		e.Status, e.Error = "failed", cause.Error()
+	}
+
+	ctx = dedupSettings(withDedupToken(ctx, dedupToken(e.Token, "ledger", e.RunID, e.Status)))
+	return Retry(ctx, "Ledger batch insert", func() error {
+		return ch.WithContext(ctx).Exec(fmt.Sprintf(`insert into %s (run_id, table_name, checkpoint, range_name, range_run_id,
+			page, after_key, last_key, after_at, last_at, rows, written, hash, token, status, error, started_at, finished_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, ledger.batches),
+			e.RunID, e.Table, e.Checkpoint, e.Range, e.RangeRunID, e.Page, e.AfterKey, e.LastKey, e.AfterAt, e.LastAt,
+			e.Rows, e.Written, e.Hash, e.Token, e.Status, e.Error, e.StartedAt, e.FinishedAt).Error
+	})
+}
+
+// contentHash returns a hash of the JSON encoding of rows, in order.
+func contentHash[D any](rows []*D) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, row := range rows {
+		enc.Encode(row)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// resumeFromLedger advances cp past the batches the ledger has written
+// after it by the run that started the range: batches that landed while
+// the run stopped before checkpointing them, the first one included.
+func resumeFromLedger(ctx context.Context, cp *Checkpoint) error {
+	if ledger == nil {
+		return nil
+	}
+
+	var written []*LedgerBatch
+	err := ch.WithContext(ctx).Raw(fmt.Sprintf(`select after_key, last_key, rows, written from %s
+		where checkpoint = ? and range_name = ? and range_run_id = ? and status = 'written'
+		order by started_at`, ledger.batches), cp.Table, cp.Range, cp.RunID).Scan(&written).Error
+	if err != nil {
+		return fmt.Errorf("Load %s ledger failed: %s", cp.Table, err.Error())
+	}
+
+	last, read, rows, batches := followLedger(cp.LastKey, written)
+	if batches == 0 {
+		return nil
+	}
+	cp.LastKey = last
+	cp.Rows += rows
+	cp.Read += read
+	slog.Info("Advanced checkpoint past ledger batches", "table", cp.Table, "range", cp.Range, "batches", batches)
+	return saveCheckpoint(cp)
+}
+
+// followLedger follows the chain of written batches, in the order they
+// were written, from the one read after the checkpoint key last, empty
+// before the first batch, and returns the key it ends at with the rows
+// read and written by the batches it went through and their number.
+func followLedger(last string, written []*LedgerBatch) (string, int64, int64, int) {
+	if last == "" {
+		last = Key{}.String()
+	}
+
+	next := make(map[string]*LedgerBatch, len(written))
+	for _, b := range written {
+		if _, ok := next[b.AfterKey]; !ok {
+			next[b.AfterKey] = b
+		}
+	}
+
+	var (
+		read, rows int64
+		batches    int
+	)
+	for b := next[last]; b != nil && b.LastKey != last; b = next[last] {
+		last = b.LastKey
+		read += b.Rows
+		rows += b.Written
+		batches++
+	}
+	return last, read, rows, batches
+}
+
+// LedgerRuns returns the latest limit runs recorded in the ledger, newest
+// first.
+func LedgerRuns(ctx context.Context, limit int) ([]*LedgerRun, error) {
+	if ledger == nil {
+		return nil, fmt.Errorf("ledger is not open")
+	}
+
+	var runs []*LedgerRun
+	err := ch.WithContext(ctx).Raw(fmt.Sprintf(`select run_id, command, filter, status, error, rows, started_at, finished_at, updated_at
+		from %s final order by started_at desc limit ?`, ledger.runs), limit).Scan(&runs).Error
+	if err != nil {
+		return nil, fmt.Errorf("Load ledger runs failed: %s", err.Error())
+	}
+	return runs, nil
+}
+
+// LedgerBatches totals the batches written and failed by a run per table.
+func LedgerBatches(ctx context.Context, run string) ([]*LedgerSummary, error) {
+	if ledger == nil {
+		return nil, fmt.Errorf("ledger is not open")
+	}
+
+	var summaries []*LedgerSummary
+	err := ch.WithContext(ctx).Raw(fmt.Sprintf(`select table_name as "table", status, count() as batches,
+			sum(rows) as rows, sum(written) as written
+		from %s where run_id = ? group by table_name, status order by table_name, status`, ledger.batches), run).Scan(&summaries).Error
+	if err != nil {
+		return nil, fmt.Errorf("Load ledger batches of run %s failed: %s", run, err.Error())
+	}
+	return summaries, nil
+}
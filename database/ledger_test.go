@@ -0,0 +1,44 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFollowLedger(t *testing.T) {
+	var (
+		k1 = Key{At: time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC), ID: "a"}.String()
+		k2 = Key{At: time.Date(2023, 5, 1, 11, 0, 0, 0, time.UTC), ID: "b"}.String()
+		k3 = Key{At: time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC), ID: "c"}.String()
+	)
+	first := &LedgerBatch{AfterKey: Key{}.String(), LastKey: k1, Rows: 11, Written: 10}
+	second := &LedgerBatch{AfterKey: k1, LastKey: k2, Rows: 20, Written: 20}
+	third := &LedgerBatch{AfterKey: k2, LastKey: k3, Rows: 7, Written: 5}
+
+	tests := []struct {
+		name    string
+		last    string
+		written []*LedgerBatch
+		want    string
+		read    int64
+		rows    int64
+		batches int
+	}{
+		{name: "nothing written", last: k1},
+		{name: "first batch not checkpointed", last: "", written: []*LedgerBatch{first}, want: k1, read: 11, rows: 10, batches: 1},
+		{name: "all batches not checkpointed", last: "", written: []*LedgerBatch{first, second, third}, want: k3, read: 38, rows: 35, batches: 3},
+		{name: "checkpointed up to the first", last: k1, written: []*LedgerBatch{first, second, third}, want: k3, read: 27, rows: 25, batches: 2},
+		{name: "all checkpointed", last: k3, written: []*LedgerBatch{first, second, third}},
+		{name: "gap", last: "", written: []*LedgerBatch{first, third}, want: k1, read: 11, rows: 10, batches: 1},
+		{name: "written twice", last: "", written: []*LedgerBatch{first, first}, want: k1, read: 11, rows: 10, batches: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last, read, rows, batches := followLedger(tt.last, tt.written)
+			if batches != tt.batches || read != tt.read || rows != tt.rows || (batches > 0 && last != tt.want) {
+				t.Errorf("followLedger() = %s, %d, %d, %d, want %s, %d, %d, %d", last, read, rows, batches, tt.want, tt.read, tt.rows, tt.batches)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"clickhouse-migrations/config"
+)
+
+// InitLogger makes the default slog logger write log.format records of
+// log.level and above to log.output, every record carrying the run ID.
+// Output of the standard log package goes through it as well.
+func InitLogger() error {
+	cfg := config.Config.Log
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", cfg.Level)
+	}
+
+	var out io.Writer
+	switch cfg.Output {
+	case "", "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Open log output failed: %s", err.Error())
+		}
+		out = f
+	}
+
+	var (
+		opts    = &slog.HandlerOptions{Level: level}
+		handler slog.Handler
+	)
+	switch cfg.Format {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", cfg.Format)
+	}
+
+	slog.SetDefault(slog.New(handler).With("run_id", runID))
+	return nil
+}
+
+// queryLogger adapts slog to the Printf loggers of gorp and gorm, logging
+// each line at level under source.
+type queryLogger struct {
+	source string
+	level  slog.Level
+}
+
+func (l queryLogger) Printf(format string, v ...interface{}) {
+	msg := strings.TrimSpace(fmt.Sprintf(format, v...))
+	slog.Log(context.Background(), l.level, msg, "source", l.source)
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"clickhouse-migrations/config"
+)
+
+// useLogConfig sets log to cfg for the duration of the test, restoring the
+// default logger and log config afterwards.
+func useLogConfig(t *testing.T, cfg config.Log) {
+	config.Config = config.Default
+	saved, logger := config.Config.Log, slog.Default()
+	t.Cleanup(func() {
+		config.Config.Log = saved
+		slog.SetDefault(logger)
+	})
+	config.Config.Log = cfg
+}
+
+func TestInitLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrate.log")
+	useLogConfig(t, config.Log{Format: "json", Level: "warn", Output: path})
+
+	if err := InitLogger(); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("Left out")
+	slog.Warn("Kept", "table", "jobs")
+	queryLogger{source: "gorm", level: slog.LevelError}.Printf("  query %s failed\n", "select 1")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, want the warn and error records", lines)
+	}
+
+	want := []map[string]string{
+		{"level": "WARN", "msg": "Kept", "table": "jobs", "run_id": runID},
+		{"level": "ERROR", "msg": "query select 1 failed", "source": "gorm", "run_id": runID},
+	}
+	for i, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("record %q is not JSON: %s", line, err)
+		}
+		for k, v := range want[i] {
+			if record[k] != v {
+				t.Errorf("record %d %s = %v, want %q", i, k, record[k], v)
+			}
+		}
+	}
+}
+
+func TestInitLoggerInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Log
+		err  string
+	}{
+		{name: "level", cfg: config.Log{Format: "text", Level: "loud"}, err: `unknown log level "loud"`},
+		{name: "format", cfg: config.Log{Format: "xml", Level: "info"}, err: `unknown log format "xml"`},
+		{name: "output", cfg: config.Log{Format: "text", Level: "info", Output: filepath.Join(t.TempDir(), "missing", "log")},
+			err: "Open log output failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLogConfig(t, tt.cfg)
+			if err := InitLogger(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("InitLogger() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Row is a source or destination row of a mapping, keyed by column name.
+type Row map[string]interface{}
+
+// MarshalJSON encodes raw bytes as strings rather than base64, so dead
+// lettered rows show the text the driver returned.
+func (r Row) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(r))
+	for k, v := range r {
+		m[k], _ = convertAny(v)
+	}
+	return json.Marshal(m)
+}
+
+// Dead letters gob encode rows, which needs the concrete types held in a
+// Row that gob does not know already.
+func init() {
+	gob.Register(time.Time{})
+}
+
+// Mapping declares a Postgres to ClickHouse migration in a mapping file
+// instead of Go code.
+//
+//	migrations:
+//	  - name: robots
+//	    source: workspace.robots
+//	    key: {at: created_at, id: id}
+//	    destination: robots
+//	    columns:
+//	      - {source: id, type: string}
+//	      - {source: name, name: robot_name, type: string, default: "", null: default}
+//	      - {source: created_at, type: time, null: error}
+//
+// Either Source (a table) or Query (a select statement) names the source
+// rows; key columns and column sources refer to the columns they return.
+// Without Columns every source column is copied unchanged.
+type Mapping struct {
+	Name        string           `yaml:"name" json:"name"`
+	Source      string           `yaml:"source" json:"source"`
+	Query       string           `yaml:"query" json:"query"`
+	Key         MappingKey       `yaml:"key" json:"key"`
+	Destination string           `yaml:"destination" json:"destination"`
+	Columns     []*MappingColumn `yaml:"columns" json:"columns"`
+}
+
+// MappingKey names the key columns. Changed optionally names a column
+// holding when a row last changed, e.g. updated_at, so incremental runs
+// pick up updated rows and not only new ones. Workspace optionally names
+// the workspace id column the -workspace filter applies to.
+type MappingKey struct {
+	At        string `yaml:"at" json:"at"`
+	ID        string `yaml:"id" json:"id"`
+	Changed   string `yaml:"changed" json:"changed"`
+	Workspace string `yaml:"workspace" json:"workspace"`
+}
+
+// MappingColumn copies the source column Source into the destination
+// column Name, converted to Type. Null decides what happens when the
+// source value is null: keep it, use Default, skip the row or fail.
+type MappingColumn struct {
+	Source  string      `yaml:"source" json:"source"`
+	Name    string      `yaml:"name" json:"name"`
+	Type    string      `yaml:"type" json:"type"`
+	Default interface{} `yaml:"default" json:"default"`
+	Null    string      `yaml:"null" json:"null"`
+}
+
+type mappingFile struct {
+	Migrations []*Mapping `yaml:"migrations" json:"migrations"`
+}
+
+var columnTypes = map[string]func(v interface{}) (interface{}, error){
+	"":       convertAny,
+	"string": convertString,
+	"int":    convertInt,
+	"float":  convertFloat,
+	"bool":   convertBool,
+	"time":   convertTime,
+	"json":   convertJSON,
+}
+
+// LoadMappings reads the mapping files at paths and registers a migration
+// for every mapping they declare. Files are parsed as YAML, which also
+// accepts JSON.
+func LoadMappings(paths []string) error {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Load mapping %s failed: %s", path, err.Error())
+		}
+
+		var f mappingFile
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("Load mapping %s failed: %s", path, err.Error())
+		}
+
+		for _, m := range f.Migrations {
+			d, err := m.definition()
+			if err != nil {
+				return fmt.Errorf("Invalid mapping %q in %s: %s", m.Name, path, err.Error())
+			}
+			if Lookup(d.Name()) != nil {
+				return fmt.Errorf("Invalid mapping %q in %s: migration already exists", m.Name, path)
+			}
+			Register(d)
+		}
+	}
+
+	return nil
+}
+
+func (m *Mapping) validate() error {
+	switch {
+	case m.Name == "":
+		return fmt.Errorf("name is required")
+	case (m.Source == "") == (m.Query == ""):
+		return fmt.Errorf("exactly one of source or query is required")
+	case m.Key.At == "" || m.Key.ID == "":
+		return fmt.Errorf("key.at and key.id are required")
+	}
+
+	if m.Destination == "" {
+		m.Destination = m.Name
+	}
+
+	for _, c := range m.Columns {
+		if c.Source == "" {
+			return fmt.Errorf("column source is required")
+		}
+		if c.Name == "" {
+			c.Name = c.Source
+		}
+
+		conv, ok := columnTypes[c.Type]
+		if !ok {
+			return fmt.Errorf("column %s: unknown type %q", c.Source, c.Type)
+		}
+
+		if c.Null == "" {
+			c.Null = "keep"
+			if c.Default != nil {
+				c.Null = "default"
+			}
+		}
+		switch c.Null {
+		case "keep", "skip", "error":
+		case "default":
+			if c.Default == nil {
+				return fmt.Errorf("column %s: null policy default needs a default value", c.Source)
+			}
+		default:
+			return fmt.Errorf("column %s: unknown null policy %q, expected keep, default, skip or error", c.Source, c.Null)
+		}
+
+		if c.Default != nil {
+			v, err := conv(c.Default)
+			if err != nil {
+				return fmt.Errorf("column %s: invalid default: %s", c.Source, err.Error())
+			}
+			c.Default = v
+		}
+
+		// keyset pagination cannot advance past rows without a key time
+		if c.Source == m.Key.At && c.Type != "time" {
+			return fmt.Errorf("key.at column %s must have type time", c.Source)
+		}
+	}
+
+	return nil
+}
+
+func (m *Mapping) definition() (*Definition[Row, Row], error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	from := m.Query
+	if from == "" {
+		from = "select * from " + m.Source
+	}
+
+	var (
+		changed                  []string
+		workspace, destWorkspace string
+	)
+	if m.Key.Changed != "" {
+		changed = []string{fmt.Sprintf(`src."%s"`, m.Key.Changed)}
+	}
+	if m.Key.Workspace != "" {
+		workspace, destWorkspace = fmt.Sprintf(`src."%s"`, m.Key.Workspace), m.destColumn(m.Key.Workspace)
+	}
+
+	return &Definition[Row, Row]{
+		Table:         m.Name,
+		Destination:   m.Destination,
+		DestKeyAt:     m.destColumn(m.Key.At),
+		DestKeyID:     m.destColumn(m.Key.ID),
+		Source:        m.Source,
+		Query:         fmt.Sprintf(`select * from (%s) src where %%s order by src."%s", src."%s" limit %%d`, from, m.Key.At, m.Key.ID),
+		KeyAt:         fmt.Sprintf(`src."%s"`, m.Key.At),
+		KeyID:         fmt.Sprintf(`src."%s"`, m.Key.ID),
+		Bounds:        fmt.Sprintf(`select min(src."%s"), max(src."%s") from (%s) src`, m.Key.At, m.Key.At, from),
+		Count:         fmt.Sprintf(`select count(*) from (%s) src`, from),
+		Changed:       changed,
+		Workspace:     workspace,
+		DestWorkspace: destWorkspace,
+		Scan:          scanRow,
+		Key:           m.key,
+		Convert:       m.convert,
+		Insert: func(ctx context.Context, rows []*Row) error {
+			maps := make([]map[string]interface{}, len(rows))
+			for i, r := range rows {
+				maps[i] = *r
+			}
+			return ch.WithContext(ctx).Table(m.Destination).Create(&maps).Error
+		},
+	}, nil
+}
+
+// destColumn returns the destination column the source column is copied to.
+func (m *Mapping) destColumn(source string) string {
+	for _, c := range m.Columns {
+		if c.Source == source {
+			return c.Name
+		}
+	}
+	return source
+}
+
+func scanRow(rows *sql.Rows) (*Row, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		vals = make([]interface{}, len(cols))
+		ptrs = make([]interface{}, len(cols))
+	)
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+
+	r := make(Row, len(cols))
+	for i, c := range cols {
+		r[c] = vals[i]
+	}
+	return &r, nil
+}
+
+func (m *Mapping) key(r *Row) (null.Time, string) {
+	var at null.Time
+	if t, ok := (*r)[m.Key.At].(time.Time); ok {
+		at = null.TimeFrom(t)
+	}
+	id, _ := convertString((*r)[m.Key.ID])
+	return at, id.(string)
+}
+
+func (m *Mapping) convert(r *Row) (*Row, error) {
+	if v := (*r)[m.Key.At]; v != nil {
+		if _, ok := v.(time.Time); !ok {
+			return nil, fmt.Errorf("key column %s is a %T, not a timestamp", m.Key.At, v)
+		}
+	}
+
+	out := make(Row, len(m.Columns))
+
+	if len(m.Columns) == 0 {
+		for k, v := range *r {
+			out[k], _ = convertAny(v)
+		}
+		return &out, nil
+	}
+
+	for _, c := range m.Columns {
+		v := (*r)[c.Source]
+		if v == nil {
+			switch c.Null {
+			case "skip":
+				return nil, nil
+			case "error":
+				return nil, fmt.Errorf("column %s is null", c.Source)
+			case "default":
+				out[c.Name] = c.Default
+			default:
+				out[c.Name] = nil
+			}
+			continue
+		}
+
+		cv, err := columnTypes[c.Type](v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %s", c.Source, err.Error())
+		}
+		out[c.Name] = cv
+	}
+
+	return &out, nil
+}
+
+// convertAny passes values through, except that raw bytes become strings.
+func convertAny(v interface{}) (interface{}, error) {
+	if b, ok := v.([]byte); ok {
+		return string(b), nil
+	}
+	return v, nil
+}
+
+func convertString(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case []byte:
+		return string(t), nil
+	case time.Time:
+		return t.Format(time.RFC3339Nano), nil
+	default:
+		return fmt.Sprint(t), nil
+	}
+}
+
+func convertInt(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case int64:
+		return t, nil
+	case int:
+		return int64(t), nil
+	case float64:
+		return int64(t), nil
+	case bool:
+		if t {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	s, _ := convertString(v)
+	return strconv.ParseInt(s.(string), 10, 64)
+}
+
+func convertFloat(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case int64:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	}
+	s, _ := convertString(v)
+	return strconv.ParseFloat(s.(string), 64)
+}
+
+func convertBool(v interface{}) (interface{}, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	s, _ := convertString(v)
+	return strconv.ParseBool(s.(string))
+}
+
+func convertTime(v interface{}) (interface{}, error) {
+	if t, ok := v.(time.Time); ok {
+		return t, nil
+	}
+	s, _ := convertString(v)
+	return time.Parse(time.RFC3339Nano, s.(string))
+}
+
+// convertJSON validates JSON values and returns them as strings, the way
+// Job.Data is stored.
+func convertJSON(v interface{}) (interface{}, error) {
+	var raw []byte
+	switch t := v.(type) {
+	case []byte:
+		raw = t
+	case string:
+		raw = []byte(t)
+	default:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+
+	if !json.Valid(raw) {
+		return nil, fmt.Errorf("invalid json")
+	}
+	return string(raw), nil
+}
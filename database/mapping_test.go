@@ -0,0 +1,169 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMappingValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping Mapping
+		err     string
+	}{
+		{
+			name:    "valid source",
+			mapping: Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"}},
+		},
+		{
+			name:    "missing name",
+			mapping: Mapping{Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"}},
+			err:     "name is required",
+		},
+		{
+			name: "source and query",
+			mapping: Mapping{Name: "robots", Source: "workspace.robots", Query: "select 1",
+				Key: MappingKey{At: "created_at", ID: "id"}},
+			err: "exactly one of source or query",
+		},
+		{
+			name:    "missing key",
+			mapping: Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{ID: "id"}},
+			err:     "key.at and key.id are required",
+		},
+		{
+			name: "unknown type",
+			mapping: Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"},
+				Columns: []*MappingColumn{{Source: "id", Type: "uuid"}}},
+			err: `unknown type "uuid"`,
+		},
+		{
+			name: "default policy without default",
+			mapping: Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"},
+				Columns: []*MappingColumn{{Source: "name", Type: "string", Null: "default"}}},
+			err: "needs a default value",
+		},
+		{
+			name: "invalid default",
+			mapping: Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"},
+				Columns: []*MappingColumn{{Source: "type", Type: "int", Default: "many"}}},
+			err: "invalid default",
+		},
+		{
+			name: "key column not a time",
+			mapping: Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"},
+				Columns: []*MappingColumn{{Source: "created_at", Type: "string"}}},
+			err: "key.at column created_at must have type time",
+		},
+		{
+			name: "key column a time",
+			mapping: Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"},
+				Columns: []*MappingColumn{{Source: "created_at", Type: "time", Null: "error"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.mapping.validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("validate() = %v, want nil", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("validate() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMappingValidateDefaults(t *testing.T) {
+	m := Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"},
+		Columns: []*MappingColumn{
+			{Source: "id", Type: "string"},
+			{Source: "type", Name: "robot_type", Type: "int", Default: 1},
+		}}
+	if err := m.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Destination != "robots" {
+		t.Errorf("Destination = %q, want robots", m.Destination)
+	}
+	if c := m.Columns[0]; c.Name != "id" || c.Null != "keep" {
+		t.Errorf("id column = %+v, want name id and null keep", c)
+	}
+	if c := m.Columns[1]; c.Null != "default" || c.Default != int64(1) {
+		t.Errorf("robot_type column = %+v, want null default and default int64(1)", c)
+	}
+}
+
+func TestMappingConvert(t *testing.T) {
+	at := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	m := Mapping{Name: "robots", Source: "workspace.robots", Key: MappingKey{At: "created_at", ID: "id"},
+		Columns: []*MappingColumn{
+			{Source: "id", Type: "string"},
+			{Source: "name", Name: "robot_name", Type: "string", Default: "unnamed"},
+			{Source: "type", Name: "robot_type", Type: "int", Null: "skip"},
+			{Source: "data", Type: "json", Null: "error"},
+			{Source: "created_at", Type: "time"},
+		}}
+	if err := m.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		row  Row
+		want *Row
+		err  string
+	}{
+		{
+			name: "converted",
+			row:  Row{"id": []byte("r1"), "name": "robot", "type": "2", "data": []byte(`{"a":1}`), "created_at": at},
+			want: &Row{"id": "r1", "robot_name": "robot", "robot_type": int64(2), "data": `{"a":1}`, "created_at": at},
+		},
+		{
+			name: "null default",
+			row:  Row{"id": "r1", "name": nil, "type": int64(1), "data": "{}", "created_at": at},
+			want: &Row{"id": "r1", "robot_name": "unnamed", "robot_type": int64(1), "data": "{}", "created_at": at},
+		},
+		{
+			name: "null skipped",
+			row:  Row{"id": "r1", "name": "robot", "type": nil, "data": "{}", "created_at": at},
+		},
+		{
+			name: "null error",
+			row:  Row{"id": "r1", "name": "robot", "type": int64(1), "data": nil, "created_at": at},
+			err:  "column data is null",
+		},
+		{
+			name: "invalid json",
+			row:  Row{"id": "r1", "name": "robot", "type": int64(1), "data": "{", "created_at": at},
+			err:  "invalid json",
+		},
+		{
+			name: "key not a timestamp",
+			row:  Row{"id": "r1", "name": "robot", "type": int64(1), "data": "{}", "created_at": "2023-05-01"},
+			err:  "not a timestamp",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.convert(&tt.row)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("convert() error = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("convert() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("convert() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "clickhouse_migrations"
+
+var (
+	rowsRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rows_read_total",
+		Help:      "Rows read from Postgres.",
+	}, []string{"table"})
+
+	rowsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rows_written_total",
+		Help:      "Rows inserted into ClickHouse.",
+	}, []string{"table"})
+
+	readSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "read_seconds",
+		Help:      "Time spent selecting and scanning one Postgres page.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"table"})
+
+	insertSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "insert_seconds",
+		Help:      "Time spent inserting one batch into ClickHouse.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"table"})
+
+	retries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retries_total",
+		Help:      "Failed connections, reads and inserts that were retried.",
+	})
+
+	deadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_letters_total",
+		Help:      "Rows sent to the dead letter sink.",
+	}, []string{"table", "stage"})
+
+	checkpointPosition = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "checkpoint_position_seconds",
+		Help:      "Key timestamp of the last checkpoint of a range, as a unix time.",
+	}, []string{"table", "range"})
+
+	rowsRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rows_remaining",
+		Help:      "Estimated source rows left to migrate.",
+	}, []string{"table"})
+)
+
+// ServeMetrics exposes the metrics on addr at /metrics in the background.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		slog.Info("Serving metrics", "addr", addr, "path", "/metrics")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics listener failed", "error", err)
+		}
+	}()
+}
+
+// observeCheckpoint records the position of cp after a batch ending at key.
+func observeCheckpoint(cp *Checkpoint, key Key) {
+	if !key.At.IsZero() {
+		checkpointPosition.WithLabelValues(cp.Table, cp.Range).Set(float64(key.At.UnixNano()) / float64(time.Second))
+	}
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"clickhouse-migrations/config"
+)
+
+func TestMigrateMetrics(t *testing.T) {
+	source := testRows(10, "", "bad1", "drop2")
+	useTestEnv(t, &fakeSource{rows: source})
+	cfg := &config.Config.Migration
+	cfg.Workers, cfg.Partition, cfg.PageSize, cfg.BatchSize = 1, "none", 4, 3
+
+	var (
+		read     = testutil.ToFloat64(rowsRead.WithLabelValues("test"))
+		written  = testutil.ToFloat64(rowsWritten.WithLabelValues("test"))
+		rejected = testutil.ToFloat64(deadLettered.WithLabelValues("test", stageConvert))
+	)
+	var inserted [][]*testRow
+	if err := testDefinition(&inserted).Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"rows_read_total", testutil.ToFloat64(rowsRead.WithLabelValues("test")) - read, 10},
+		{"rows_written_total", testutil.ToFloat64(rowsWritten.WithLabelValues("test")) - written, 8},
+		{"dead_letters_total", testutil.ToFloat64(deadLettered.WithLabelValues("test", stageConvert)) - rejected, 1},
+		{"rows_remaining", testutil.ToFloat64(rowsRemaining.WithLabelValues("test")), 0},
+		{"checkpoint_position_seconds", testutil.ToFloat64(checkpointPosition.WithLabelValues("test", "all")),
+			float64(source[len(source)-1].At.Unix())},
+	} {
+		if m.got != m.want {
+			t.Errorf("%s = %v, want %v", m.name, m.got, m.want)
+		}
+	}
+}
+
+func TestObserveCheckpoint(t *testing.T) {
+	cp := &Checkpoint{Table: "observed", Range: "2023-05"}
+	key := Key{At: testRows(1)[0].At, ID: "a"}
+
+	observeCheckpoint(cp, key)
+	if got, want := testutil.ToFloat64(checkpointPosition.WithLabelValues("observed", "2023-05")), float64(key.At.Unix()); got != want {
+		t.Errorf("checkpoint_position_seconds = %v, want %v", got, want)
+	}
+
+	// rows without a key time leave the position alone
+	observeCheckpoint(cp, Key{ID: "b"})
+	if got, want := testutil.ToFloat64(checkpointPosition.WithLabelValues("observed", "2023-05")), float64(key.At.Unix()); got != want {
+		t.Errorf("checkpoint_position_seconds = %v after a null key, want %v", got, want)
+	}
+}
@@ -0,0 +1,529 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	null "gopkg.in/guregu/null.v3"
+
+	"clickhouse-migrations/config"
+)
+
+// Migrator copies one source table from Postgres into ClickHouse.
+type Migrator interface {
+	// Name identifies the migration on the command line and in checkpoints.
+	Name() string
+	Migrate(ctx context.Context) error
+	Status(ctx context.Context) (*TableStatus, error)
+	Verify(ctx context.Context) ([]*PartitionDiff, error)
+	// Repair inserts the source rows keyed in [from, to) that are missing
+	// in ClickHouse and returns how many it inserted.
+	Repair(ctx context.Context, from, to time.Time) (int64, error)
+	// Increment copies the source rows changed since the last stored
+	// watermark, less overlap, and returns how many it copied.
+	Increment(ctx context.Context, overlap time.Duration) (int64, error)
+	// Replay inserts the dead lettered rows of the table again and returns
+	// how many it inserted.
+	Replay(ctx context.Context) (int64, error)
+	// Plan dry runs Migrate without writing to ClickHouse.
+	Plan(ctx context.Context) (*Plan, error)
+}
+
+// Definition is a Migrator built from a keyset-paged Postgres query. The
+// source is split into key ranges that migration.workers goroutines copy
+// concurrently. Within a range, rows of type S are scanned one at a time,
+// converted to D and handed to a writer in batches of migration.batchsize,
+// so reading the next batch overlaps with inserting the current one and
+// memory use does not depend on the table size.
+type Definition[S any, D any] struct {
+	Table string
+	// Destination is the ClickHouse table D rows are inserted into, and
+	// DestKeyAt, DestKeyID the columns KeyAt and KeyID are copied to.
+	Destination          string
+	DestKeyAt, DestKeyID string
+
+	// Source is the Postgres table Query reads from, whose planner
+	// estimate is used as the row count when progress.count is estimate.
+	Source string
+	// Query selects the source rows. It takes the keyset predicate and the
+	// page size as its two format verbs and must order by KeyAt, KeyID.
+	Query        string
+	KeyAt, KeyID string
+	// Bounds selects the minimum and maximum of KeyAt, used to plan ranges.
+	Bounds string
+	// Count counts the source rows Query selects over the whole table.
+	Count string
+	// Workspace and DestWorkspace are the source and destination workspace
+	// id columns the workspace filter applies to; without them the table
+	// cannot be filtered by workspace.
+	Workspace, DestWorkspace string
+	// DestDeleted is the Bool column of Destination marking deleted rows,
+	// if any, which destination counts leave out.
+	DestDeleted string
+	// Changed are columns of the source row, one of which is at least the
+	// time the row last changed, used by incremental runs. Each is
+	// compared on its own, so an index on every column serves the query.
+	// It defaults to KeyAt, which only picks up new rows.
+	Changed []string
+	// Verification compares partitions of both sides; without it only
+	// whole table counts are compared.
+	Verification *Verification
+
+	Scan func(rows *sql.Rows) (*S, error)
+	Key  func(row *S) (null.Time, string)
+	// Convert maps a source row to a destination row. A nil row without an
+	// error drops the source row; an error dead letters it. Rows are dead
+	// lettered as JSON, so S and D have to round trip through it.
+	Convert func(row *S) (*D, error)
+	// Insert writes a batch into Destination. It defaults to a GORM create,
+	// which requires D to be a struct, or the native writer.
+	Insert func(ctx context.Context, rows []*D) error
+	// Columns names the Destination columns the native writer inserts and
+	// Values returns them for rows, one slice per column in that order.
+	// Without Values batches go through GORM whatever insert.writer is.
+	Columns []string
+	Values  func(rows []*D) []interface{}
+}
+
+func (d *Definition[S, D]) Name() string {
+	return d.Table
+}
+
+// batch is a converted chunk of a range ending at key last. read counts
+// the source rows it went through, including the ones skipped, rejected or
+// converted to nothing.
+type batch[D any] struct {
+	rows []*D
+	last Key
+	read int
+}
+
+func (d *Definition[S, D]) ranges(ctx context.Context) ([]*keyRange, error) {
+	var min, max null.Time
+	if err := db.Db.QueryRowContext(ctx, d.Bounds).Scan(&min, &max); err != nil {
+		return nil, fmt.Errorf("Plan %s ranges failed: %s", d.Table, err.Error())
+	}
+	ranges, err := splitRanges(min, max, config.Config.Migration.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return d.restrict(ranges)
+}
+
+// Migrate copies every range not completed yet. When ctx is cancelled the
+// batches being inserted are finished and checkpointed, no new ones are
+// started, and ctx.Err() is returned.
+func (d *Definition[S, D]) Migrate(ctx context.Context) (err error) {
+	ctx, span := startTable(ctx, "migrate", d.Table, d.Destination)
+	reportTable(d.Table)
+	defer func() {
+		finishReport(d.Table, err)
+		endSpan(span, err)
+	}()
+
+	if s := LookupSchema(d.Destination); s != nil {
+		if err := s.Check(); err != nil {
+			return err
+		}
+	}
+
+	ranges, err := d.ranges(ctx)
+	if err != nil {
+		return err
+	}
+
+	cps, err := startCheckpoints(checkpointName(d.Table), ranges)
+	if err != nil {
+		return err
+	}
+
+	p := d.startProgress(ctx, cps)
+	defer p.finish()
+	updateReport(d.Table, func(t *TableReport) { t.SourceRows = p.total })
+
+	// a failing range cancels the others through runCtx
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		workers = config.Config.Migration.Workers
+		queue   = make(chan int)
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		runErr  error
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if runCtx.Err() != nil {
+					continue
+				}
+				if err := d.migrateRange(runCtx, ranges[i], cps[i], p); err != nil {
+					if !errors.Is(err, context.Canceled) {
+						errOnce.Do(func() { runErr = err })
+					}
+					cancel()
+				}
+			}
+		}()
+	}
+
+	for i, cp := range cps {
+		if cp.Done {
+			slog.Info("Range already completed", "table", d.Table, "range", cp.Range, "by_run", cp.RunID)
+			continue
+		}
+		if runCtx.Err() != nil {
+			break
+		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	updateReport(d.Table, func(t *TableReport) { t.Checkpoints = cps })
+
+	if runErr != nil {
+		return runErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var rows int64
+	for _, cp := range cps {
+		rows += cp.Rows
+	}
+	span.SetAttributes(attribute.Int64("rows", rows), attribute.Int("ranges", len(ranges)))
+	slog.Info("Migration completed", "table", d.Table, "rows", rows, "ranges", len(ranges))
+	return nil
+}
+
+// migrateRange copies one range, resuming after the key stored in cp.
+func (d *Definition[S, D]) migrateRange(ctx context.Context, r *keyRange, cp *Checkpoint, p *progress) (err error) {
+	ctx, span := tracer.Start(ctx, "range", trace.WithAttributes(rangeAttributes(d.Table, r)...))
+	defer func() {
+		span.SetAttributes(attribute.Int64("rows", cp.Rows))
+		endSpan(span, err)
+	}()
+
+	if err := resumeFromLedger(ctx, cp); err != nil {
+		return err
+	}
+	key, err := parseKey(cp.LastKey)
+	if err != nil {
+		return fmt.Errorf("Invalid %s checkpoint %q: %s", d.Table, cp.LastKey, err.Error())
+	}
+	if cp.LastKey != "" {
+		slog.Info("Resuming range", "table", d.Table, "range", r.Name, "from_run", cp.RunID, "after", key.String())
+	}
+
+	var (
+		batches = make(chan *batch[D], 1)
+		readErr = make(chan error, 1)
+		after   = key
+	)
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		defer close(batches)
+		readErr <- d.read(readCtx, r, key, nil, batches)
+	}()
+
+	for page := 1; ; page++ {
+		b, ok := <-batches
+		if !ok || ctx.Err() != nil {
+			break
+		}
+
+		// an insert that started is finished even if ctx is cancelled
+		// meanwhile, so the checkpoint says whether the batch landed
+		start := time.Now()
+		n, err := d.writeBatch(context.WithoutCancel(ctx), cp.RunID, r, page, after, b)
+		if err != nil {
+			return fmt.Errorf("Migrate %s failed on create: %s", d.Table, err.Error())
+		}
+		after = b.last
+
+		cp.Rows += int64(n)
+		cp.Read += int64(b.read)
+		cp.LastKey = b.last.String()
+		if err := saveCheckpoint(cp); err != nil {
+			return err
+		}
+		observeCheckpoint(cp, b.last)
+		p.add(b.read)
+		slog.Debug("Batch inserted", "table", d.Table, "range", r.Name, "page", page, "rows", n,
+			"duration", time.Since(start), "total_rows", cp.Rows)
+	}
+
+	if err := ctx.Err(); err != nil {
+		cancel()
+		<-readErr
+		if err := saveCheckpoint(cp); err != nil {
+			return err
+		}
+		slog.Info("Range stopped", "table", d.Table, "range", r.Name, "rows", cp.Rows, "checkpoint", cp.LastKey)
+		return err
+	}
+	if err := <-readErr; err != nil {
+		return err
+	}
+
+	cp.Done = true
+	if err := saveCheckpoint(cp); err != nil {
+		return err
+	}
+	slog.Info("Range completed", "table", d.Table, "range", r.Name, "rows", cp.Rows)
+	return nil
+}
+
+// copyRange inserts the rows of r whose id skip does not report, which may
+// be nil, without checkpointing. verb names the operation in messages.
+func (d *Definition[S, D]) copyRange(ctx context.Context, verb string, r *keyRange, skip func(id string) bool) (int64, error) {
+	var (
+		batches = make(chan *batch[D], 1)
+		readErr = make(chan error, 1)
+		copied  int64
+		after   Key
+		// copies are not resumed, so only retries within one share
+		// deduplication tokens, not a later copy of changed rows
+		run = uuid.NewString()
+	)
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		defer close(batches)
+		readErr <- d.read(readCtx, r, Key{}, skip, batches)
+	}()
+
+	for page := 1; ; page++ {
+		b, ok := <-batches
+		if !ok || ctx.Err() != nil {
+			break
+		}
+
+		start := time.Now()
+		n, err := d.writeBatch(context.WithoutCancel(ctx), run, r, page, after, b)
+		if err != nil {
+			return copied, fmt.Errorf("%s %s failed on create: %s", verb, d.Table, err.Error())
+		}
+		after = b.last
+		copied += int64(n)
+		slog.Debug("Batch inserted", "op", verb, "table", d.Table, "page", page, "rows", n,
+			"duration", time.Since(start), "total_rows", copied)
+	}
+
+	if err := ctx.Err(); err != nil {
+		cancel()
+		<-readErr
+		return copied, err
+	}
+	return copied, <-readErr
+}
+
+// writeBatch writes the page-th batch of r, read after key by run, in a
+// span, with a deduplication token derived from those, and records it in
+// the ledger. A batch of rows that were all left out writes nothing. The
+// ledger is no part of the write: failing to record a batch is logged and
+// does not fail it.
+func (d *Definition[S, D]) writeBatch(ctx context.Context, run string, r *keyRange, page int, after Key, b *batch[D]) (n int, err error) {
+	if len(b.rows) == 0 {
+		return 0, nil
+	}
+
+	token := dedupToken(checkpointName(d.Table), run, r.Name, after.String(), b.last.String())
+	attrs := append(rangeAttributes(d.Table, r), keyAttributes(after, b.last)...)
+	ctx, span := tracer.Start(ctx, "batch", trace.WithAttributes(append(attrs,
+		attribute.Int("page", page),
+		attribute.Int("rows", len(b.rows)),
+		attribute.String("dedup.token", token),
+	)...))
+	defer func() {
+		span.SetAttributes(attribute.Int("rows.written", n))
+		endSpan(span, err)
+	}()
+
+	entry := d.ledgerEntry(run, r, page, after, b, token)
+	n, err = d.write(withDedupToken(ctx, token), b.rows)
+	if lerr := entry.record(ctx, n, err); lerr != nil {
+		slog.Warn("Record batch in ledger failed", "table", d.Table, "range", r.Name, "page", page, "error", lerr)
+	}
+	return n, err
+}
+
+func (d *Definition[S, D]) insert(ctx context.Context, rows []*D) (err error) {
+	ctx, span := tracer.Start(ctx, "insert", trace.WithAttributes(
+		attribute.String("table", d.Table),
+		attribute.String("destination", d.Destination),
+		attribute.Int("rows", len(rows)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	ctx = dedupSettings(ctx)
+	return Retry(ctx, fmt.Sprintf("Insert into %s", d.Destination), func() error {
+		defer prometheus.NewTimer(insertSeconds.WithLabelValues(d.Table)).ObserveDuration()
+
+		switch {
+		case d.Insert != nil:
+			return d.Insert(ctx, rows)
+		case d.Values != nil && config.Config.Insert.Writer == "native":
+			return d.insertNative(ctx, d.Destination, rows)
+		}
+		return ch.WithContext(ctx).Table(d.Destination).Create(rows).Error
+	})
+}
+
+// read pages through r after key and sends converted batches to out until
+// the range is exhausted or ctx is cancelled. Rows whose id skip reports
+// are left out; skip may be nil.
+func (d *Definition[S, D]) read(ctx context.Context, r *keyRange, key Key, skip func(id string) bool, out chan<- *batch[D]) error {
+	var (
+		cfg = config.Config.Migration
+		b   = &batch[D]{rows: make([]*D, 0, cfg.BatchSize)}
+	)
+
+	send := func() error {
+		select {
+		case out <- b:
+			b = &batch[D]{rows: make([]*D, 0, cfg.BatchSize)}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Rows are converted as they are scanned and a batch is sent as soon
+	// as it fills, so no more than a batch is held while the writer
+	// inserts the previous one. The query span covers a page; the convert
+	// span runs from its first row to its end, overlapping the query. A
+	// page failing part way is retried from the last key it read, so no
+	// row is converted twice.
+	var n int
+	readPage := func() (err error) {
+		var (
+			after     = key
+			rejected  int
+			converted int
+			convert   trace.Span
+		)
+		qctx, span := tracer.Start(ctx, "query", trace.WithAttributes(append(rangeAttributes(d.Table, r),
+			attribute.String("key.after", key.String()))...))
+		defer func() {
+			if convert != nil {
+				convert.SetAttributes(keyAttributes(after, key)...)
+				convert.SetAttributes(attribute.Int("rows", converted), attribute.Int("rows.rejected", rejected))
+				endSpan(convert, err)
+			}
+			span.SetAttributes(attribute.Int("rows", n))
+			endSpan(span, err)
+		}()
+
+		where, args := r.where(d.KeyAt, d.KeyID, key)
+		n, err = d.page(qctx, fmt.Sprintf(d.Query, where, cfg.PageSize), args, func(row *S) error {
+			if convert == nil {
+				_, convert = tracer.Start(ctx, "convert", trace.WithAttributes(rangeAttributes(d.Table, r)...))
+			}
+			key = keyOf(d.Key(row))
+			b.last = key
+			b.read++
+
+			if skip != nil && skip(key.ID) {
+				return nil
+			}
+
+			converted++
+			out, err := d.Convert(row)
+			if err != nil {
+				if err := d.reject(ctx, stageConvert, row, err); err != nil {
+					return fmt.Errorf("Migrate %s failed on convert: %s", d.Table, err.Error())
+				}
+				rejected++
+				return nil
+			}
+			if out == nil {
+				return nil
+			}
+
+			b.rows = append(b.rows, out)
+			if len(b.rows) < cfg.BatchSize {
+				return nil
+			}
+			return send()
+		})
+		return err
+	}
+
+	for {
+		prev := key
+		if err := Retry(ctx, fmt.Sprintf("Read %s range %s", d.Table, r.Name), readPage); err != nil {
+			return err
+		}
+
+		if n < cfg.PageSize {
+			// a batch of rejected rows only still advances the checkpoint
+			if b.read == 0 {
+				return nil
+			}
+			return send()
+		}
+		// a key that does not advance over a full page, e.g. one that is
+		// not a timestamp, would read the same page forever
+		if key == prev {
+			return fmt.Errorf("Read %s range %s failed: key did not advance past %s", d.Table, r.Name, key.String())
+		}
+	}
+}
+
+// page runs query and hands every scanned row to fn, returning the number
+// of rows read. The time spent in fn is left out of the read_seconds metric.
+func (d *Definition[S, D]) page(ctx context.Context, query string, args []interface{}, fn func(row *S) error) (int, error) {
+	var (
+		start   = time.Now()
+		waiting time.Duration
+		n       int
+	)
+	defer func() {
+		readSeconds.WithLabelValues(d.Table).Observe((time.Since(start) - waiting).Seconds())
+		rowsRead.WithLabelValues(d.Table).Add(float64(n))
+	}()
+
+	rows, err := db.Db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("Migrate %s failed: %w", d.Table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row, err := d.Scan(rows)
+		if err != nil {
+			return n, fmt.Errorf("Migrate %s failed on scan: %s", d.Table, err.Error())
+		}
+
+		t := time.Now()
+		err = fn(row)
+		waiting += time.Since(t)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("Migrate %s failed: %w", d.Table, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,349 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+
+	"clickhouse-migrations/config"
+)
+
+func TestReadBatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		rows      []*testRow
+		pageSize  int
+		batchSize int
+		batches   []int
+		pages     int
+		rejected  int
+	}{
+		{name: "empty", pageSize: 10, batchSize: 4, pages: 1},
+		{name: "pages and batches", rows: testRows(25), pageSize: 10, batchSize: 4,
+			batches: []int{4, 4, 4, 4, 4, 4, 1}, pages: 3},
+		{name: "last page full", rows: testRows(20), pageSize: 10, batchSize: 4,
+			batches: []int{4, 4, 4, 4, 4}, pages: 3},
+		{name: "rejected and dropped rows", rows: testRows(10, "", "bad1", "", "drop1", "", "", "bad2"), pageSize: 4, batchSize: 3,
+			batches: []int{3, 3, 1}, pages: 3, rejected: 2},
+		{name: "batch larger than a page", rows: testRows(7), pageSize: 2, batchSize: 5,
+			batches: []int{5, 2}, pages: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeSource{rows: tt.rows}
+			useTestEnv(t, src)
+			cfg := &config.Config.Migration
+			cfg.PageSize, cfg.BatchSize = tt.pageSize, tt.batchSize
+
+			var (
+				d       = testDefinition(nil)
+				out     = make(chan *batch[testRow])
+				readErr = make(chan error, 1)
+			)
+			go func() {
+				defer close(out)
+				readErr <- d.read(context.Background(), &keyRange{Name: "all"}, Key{}, nil, out)
+			}()
+
+			var (
+				sizes []int
+				rows  []*testRow
+				last  Key
+			)
+			for b := range out {
+				sizes = append(sizes, len(b.rows))
+				rows = append(rows, b.rows...)
+				last = b.last
+			}
+			if err := <-readErr; err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(sizes, tt.batches) {
+				t.Errorf("batch sizes = %v, want %v", sizes, tt.batches)
+			}
+			if want := len(tt.rows) - tt.rejected - countPrefix(tt.rows, "drop"); len(rows) != want {
+				t.Errorf("read %d rows, want %d", len(rows), want)
+			}
+			for i := 1; i < len(rows); i++ {
+				if !rows[i-1].At.Before(rows[i].At) {
+					t.Fatalf("rows %s and %s out of key order", rows[i-1].ID, rows[i].ID)
+				}
+			}
+			if len(tt.rows) > 0 && len(sizes) > 0 {
+				if want := keyOf(d.Key(tt.rows[len(tt.rows)-1])); last != want {
+					t.Errorf("last batch ends at %s, want %s", last, want)
+				}
+			}
+			if got := src.pages(); got != tt.pages {
+				t.Errorf("ran %d page queries, want %d", got, tt.pages)
+			}
+
+			letters, err := deadLetters.Load("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(letters) != tt.rejected {
+				t.Errorf("dead lettered %d rows, want %d", len(letters), tt.rejected)
+			}
+		})
+	}
+}
+
+func TestReadStreamsBatches(t *testing.T) {
+	received := make(chan struct{})
+	src := &fakeSource{rows: testRows(10)}
+	src.before = func(i int) {
+		// the rest of the page is only scanned once the first batch is
+		// with the writer, as a page of a million rows would be
+		if i != 6 {
+			return
+		}
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Error("first batch not sent before its page was scanned")
+		}
+	}
+	useTestEnv(t, src)
+	cfg := &config.Config.Migration
+	cfg.PageSize, cfg.BatchSize = 10, 3
+
+	var (
+		out     = make(chan *batch[testRow])
+		readErr = make(chan error, 1)
+	)
+	go func() {
+		defer close(out)
+		readErr <- testDefinition(nil).read(context.Background(), &keyRange{Name: "all"}, Key{}, nil, out)
+	}()
+
+	var sizes []int
+	for b := range out {
+		if len(sizes) == 0 {
+			close(received)
+		}
+		sizes = append(sizes, len(b.rows))
+	}
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 3, 3, 1}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("batch sizes = %v, want %v", sizes, want)
+	}
+}
+
+func countPrefix(rows []*testRow, prefix string) int {
+	var n int
+	for _, r := range rows {
+		if strings.HasPrefix(r.ID, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// monthRows returns n rows two days apart from 2023-04-20, in ranges
+// 2023-04 to 2023-06 when n is 30.
+func monthRows(n int) []*testRow {
+	rows := make([]*testRow, n)
+	for i := range rows {
+		rows[i] = &testRow{At: time.Date(2023, 4, 20, 0, 0, 0, 0, time.UTC).AddDate(0, 0, 2*i), ID: fmt.Sprintf("r%03d", i)}
+	}
+	return rows
+}
+
+func TestMigrate(t *testing.T) {
+	source := monthRows(30)
+	source[3].ID, source[17].ID = "bad3", "bad17"
+
+	tests := []struct {
+		name     string
+		workers  int
+		resume   bool
+		stored   []*Checkpoint
+		inserted []string
+	}{
+		{name: "one worker", workers: 1, inserted: ids(source, 0, 30)},
+		{name: "parallel ranges", workers: 3, inserted: ids(source, 0, 30)},
+		{
+			name:    "resume",
+			workers: 2,
+			resume:  true,
+			stored: []*Checkpoint{
+				{RunID: "earlier", Table: "test", Range: "2023-04", LastKey: keyOf(null.TimeFrom(source[5].At), source[5].ID).String(), Rows: 5, Read: 6, Done: true},
+				{RunID: "earlier", Table: "test", Range: "2023-05", LastKey: keyOf(null.TimeFrom(source[9].At), source[9].ID).String(), Rows: 4, Read: 4},
+			},
+			inserted: ids(source, 10, 30),
+		},
+		{
+			name:    "checkpoints ignored without resume",
+			workers: 2,
+			stored: []*Checkpoint{
+				{RunID: "earlier", Table: "test", Range: "2023-04", Rows: 5, Read: 6, Done: true},
+			},
+			inserted: ids(source, 0, 30),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestEnv(t, &fakeSource{rows: source})
+			cfg := &config.Config.Migration
+			cfg.Workers, cfg.Resume, cfg.Partition, cfg.PageSize, cfg.BatchSize = tt.workers, tt.resume, "month", 4, 3
+			for _, cp := range tt.stored {
+				if err := saveCheckpoint(cp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var inserted [][]*testRow
+			if err := testDefinition(&inserted).Migrate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, b := range inserted {
+				for _, r := range b {
+					got = append(got, r.ID)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.inserted) {
+				t.Errorf("inserted %v, want %v", got, tt.inserted)
+			}
+
+			cps, err := checkpoints.Load("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rows, read int64
+			for _, cp := range cps {
+				if !cp.Done {
+					t.Errorf("range %s not done", cp.Range)
+				}
+				rows += cp.Rows
+				read += cp.Read
+			}
+			if len(cps) != 4 {
+				t.Errorf("stored %d checkpoints, want one per range of 2023-04 to 2023-06 and null", len(cps))
+			}
+			if want := int64(len(source) - 2); rows != want {
+				t.Errorf("checkpoints count %d rows, want %d", rows, want)
+			}
+			if want := int64(len(source)); read != want {
+				t.Errorf("checkpoints count %d rows read, want %d", read, want)
+			}
+		})
+	}
+}
+
+func TestMigrateFailingRange(t *testing.T) {
+	useTestEnv(t, &fakeSource{rows: monthRows(30)})
+	cfg := &config.Config.Migration
+	cfg.Workers, cfg.Partition, cfg.PageSize, cfg.BatchSize = 2, "month", 4, 3
+	config.Config.Retry.Attempts = 1
+
+	// a retryable error is not dead lettered but fails the range once
+	// retries are exhausted
+	d := testDefinition(nil)
+	d.Insert = func(ctx context.Context, rows []*testRow) error {
+		if rows[0].At.Month() == time.May {
+			return driver.ErrBadConn
+		}
+		return nil
+	}
+
+	err := d.Migrate(context.Background())
+	if err == nil || !strings.Contains(err.Error(), driver.ErrBadConn.Error()) {
+		t.Fatalf("Migrate() = %v, want the insert error", err)
+	}
+
+	cps, err := checkpoints.Load("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cp := range cps {
+		if cp.Range == "2023-05" && cp.Done {
+			t.Errorf("failed range %s is done", cp.Range)
+		}
+	}
+}
+
+// ids returns the ids of rows[from:to] that convert, sorted.
+func ids(rows []*testRow, from, to int) []string {
+	var ids []string
+	for _, r := range rows[from:to] {
+		if !strings.HasPrefix(r.ID, "bad") {
+			ids = append(ids, r.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestMigrateCancelled(t *testing.T) {
+	source := testRows(20)
+	useTestEnv(t, &fakeSource{rows: source})
+	cfg := &config.Config.Migration
+	cfg.Workers, cfg.Partition, cfg.PageSize, cfg.BatchSize = 1, "none", 4, 2
+
+	// a signal arriving during the second insert lets it finish
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var inserted [][]*testRow
+	d := testDefinition(&inserted)
+	insert := d.Insert
+	d.Insert = func(ictx context.Context, rows []*testRow) error {
+		if len(inserted) == 1 {
+			cancel()
+		}
+		return insert(ictx, rows)
+	}
+
+	if err := d.Migrate(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Migrate() = %v, want context.Canceled", err)
+	}
+	if len(inserted) != 2 {
+		t.Fatalf("inserted %d batches, want 2", len(inserted))
+	}
+
+	cps, err := checkpoints.Load("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all *Checkpoint
+	for _, cp := range cps {
+		if cp.Range == "all" {
+			all = cp
+		}
+	}
+	if want := keyOf(d.Key(source[3])).String(); all == nil || all.Done || all.Rows != 4 || all.LastKey != want {
+		t.Fatalf("checkpoint = %+v, want 4 rows up to %s, not done", all, want)
+	}
+
+	// resuming copies the rest once
+	cfg.Resume = true
+	d.Insert = insert
+	if err := d.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range inserted {
+		for _, r := range b {
+			got = append(got, r.ID)
+		}
+	}
+	if want := ids(source, 0, 20); !reflect.DeepEqual(got, want) {
+		t.Errorf("inserted %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+
+	"clickhouse-migrations/config"
+)
+
+// native is the clickhouse-go connection of the native writer, which sends
+// batches as columnar blocks instead of the INSERT statements GORM builds
+// by reflecting over every row.
+var native driver.Conn
+
+var compressions = map[string]clickhouse.CompressionMethod{
+	"lz4":  clickhouse.CompressionLZ4,
+	"zstd": clickhouse.CompressionZSTD,
+	"none": clickhouse.CompressionNone,
+}
+
+// openNative sets up the native writer connection. Opening it does not
+// dial, so it is only pinged when insert.writer is native.
+func openNative(ctx context.Context) error {
+	cfg := config.Config
+
+	switch cfg.Insert.Writer {
+	case "gorm", "native":
+	default:
+		return fmt.Errorf("Unknown insert writer %q, expected gorm or native", cfg.Insert.Writer)
+	}
+	method, ok := compressions[cfg.Insert.Compression]
+	if !ok {
+		return fmt.Errorf("Unknown insert compression %q, expected lz4, zstd or none", cfg.Insert.Compression)
+	}
+	if cfg.Insert.BlockSize <= 0 {
+		return fmt.Errorf("Invalid insert block size %d", cfg.Insert.BlockSize)
+	}
+
+	conn, err := clickhouse.Open(&clickhouse.Options{
+		Addr: []string{fmt.Sprintf("%s:%d", cfg.ClickHouse.IP, cfg.ClickHouse.Port)},
+		Auth: clickhouse.Auth{
+			Database: cfg.ClickHouse.Name,
+			Username: cfg.ClickHouse.User,
+			Password: cfg.ClickHouse.Password,
+		},
+		Compression:  &clickhouse.Compression{Method: method},
+		DialTimeout:  10 * time.Second,
+		ReadTimeout:  20 * time.Second,
+		MaxOpenConns: cfg.Migration.Workers + 5,
+	})
+	if err != nil {
+		return err
+	}
+	native = conn
+
+	if cfg.Insert.Writer != "native" {
+		return nil
+	}
+	return native.Ping(ctx)
+}
+
+// insertNative sends rows to table in one INSERT of insert.blocksize row
+// blocks, appending every column of a block as a whole.
+func (d *Definition[S, D]) insertNative(ctx context.Context, table string, rows []*D) error {
+	b, err := native.PrepareBatch(ctx, fmt.Sprintf("insert into %s (%s)", table, strings.Join(d.Columns, ", ")))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !b.IsSent() {
+			b.Abort()
+		}
+	}()
+
+	size := config.Config.Insert.BlockSize
+	for start := 0; start < len(rows); start += size {
+		end := min(start+size, len(rows))
+		for i, values := range d.Values(rows[start:end]) {
+			if err := b.Column(i).Append(values); err != nil {
+				return fmt.Errorf("append %s: %s", d.Columns[i], err.Error())
+			}
+		}
+		if end < len(rows) {
+			if err := b.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return b.Send()
+}
@@ -0,0 +1,300 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"clickhouse-migrations/config"
+)
+
+// Plan is what migrating a table would do, found by a dry run that
+// explains and counts the source query and converts a sample of rows
+// without writing anything.
+type Plan struct {
+	Table         string
+	Destination   string
+	EstimatedRows int64
+	Rows          int64
+	Batches       int64
+	Ranges        []*PlanRange
+	Explain       []string
+	Sampled       int
+	// Problems found converting the sample and checking it against the
+	// destination columns, each with how many sampled rows it affected.
+	Problems []string
+}
+
+type PlanRange struct {
+	Name string
+	From time.Time
+	To   time.Time
+	Done bool
+}
+
+// Plan dry runs the migration of the table. Resumed ranges which are done
+// are marked so.
+func (d *Definition[S, D]) Plan(ctx context.Context) (plan *Plan, err error) {
+	ctx, span := startTable(ctx, "plan", d.Table, d.Destination)
+	defer func() { endSpan(span, err) }()
+
+	cfg := config.Config.Migration
+	plan = &Plan{Table: d.Table, Destination: d.Destination}
+
+	if s := LookupSchema(d.Destination); s != nil {
+		if err := s.Check(); err != nil {
+			plan.Problems = append(plan.Problems, err.Error())
+		}
+	}
+
+	ranges, err := d.ranges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cps, err := startCheckpoints(checkpointName(d.Table), ranges)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range ranges {
+		plan.Ranges = append(plan.Ranges, &PlanRange{Name: r.Name, From: r.From, To: r.To, Done: cps[i].Done})
+	}
+
+	// the planner estimate is of the whole table
+	plan.EstimatedRows = -1
+	if filter.IsZero() {
+		if plan.EstimatedRows, err = d.estimateRows(ctx); err != nil {
+			return nil, fmt.Errorf("Plan %s failed on estimate: %s", d.Table, err.Error())
+		}
+	}
+	if plan.Rows, err = d.count(ctx); err != nil {
+		return nil, fmt.Errorf("Plan %s failed on count: %s", d.Table, err.Error())
+	}
+	if cfg.BatchSize > 0 {
+		plan.Batches = (plan.Rows + int64(cfg.BatchSize) - 1) / int64(cfg.BatchSize)
+	}
+
+	if len(ranges) == 0 {
+		return plan, nil
+	}
+
+	// the first page of the first range shows how every page is read
+	where, args := ranges[0].where(d.KeyAt, d.KeyID, Key{})
+	if plan.Explain, err = explain(ctx, fmt.Sprintf(d.Query, where, cfg.PageSize), args); err != nil {
+		return nil, fmt.Errorf("Plan %s failed on explain: %s", d.Table, err.Error())
+	}
+
+	columns, err := destinationColumns(d.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("Plan %s failed on columns: %s", d.Table, err.Error())
+	}
+	if len(columns) == 0 {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("ClickHouse table %s does not exist", d.Destination))
+	}
+
+	sample, err := d.restrict([]*keyRange{{Name: "sample"}})
+	if err != nil {
+		return nil, err
+	}
+	problems := map[string]int{}
+	where, args = sample[0].where(d.KeyAt, d.KeyID, Key{})
+	_, err = d.page(ctx, fmt.Sprintf(d.Query, where, cfg.Sample), args, func(row *S) error {
+		plan.Sampled++
+
+		out, err := d.Convert(row)
+		if err != nil {
+			problems["convert failed: "+err.Error()]++
+			return nil
+		}
+		if out == nil || len(columns) == 0 {
+			return nil
+		}
+
+		values, err := columnValues(out)
+		if err != nil {
+			return err
+		}
+		for _, p := range checkColumns(d.Destination, columns, values) {
+			problems[p]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Plan %s failed on sample: %s", d.Table, err.Error())
+	}
+
+	var found []string
+	for p, n := range problems {
+		found = append(found, fmt.Sprintf("%s (%d of %d sampled rows)", p, n, plan.Sampled))
+	}
+	sort.Strings(found)
+	plan.Problems = append(plan.Problems, found...)
+
+	return plan, nil
+}
+
+// explain returns the Postgres plan of query.
+func explain(ctx context.Context, query string, args []interface{}) ([]string, error) {
+	rows, err := db.Db.QueryContext(ctx, "explain "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// destinationColumns returns the types of the columns of the ClickHouse
+// table by name, empty if it does not exist.
+func destinationColumns(table string) (map[string]string, error) {
+	var columns []*columnInfo
+	err := ch.Raw(`select name, type from system.columns
+		where database = currentDatabase() and table = ?`, table).Scan(&columns).Error
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]string, len(columns))
+	for _, c := range columns {
+		types[c.Name] = c.Type
+	}
+	return types, nil
+}
+
+// columnValues returns the values a converted row would be inserted with,
+// by column: the entries of a mapped Row, or the fields of a model as GORM
+// names them.
+func columnValues(row interface{}) (map[string]interface{}, error) {
+	if r, ok := row.(*Row); ok {
+		return *r, nil
+	}
+
+	stmt := &gorm.Statement{DB: ch}
+	if err := stmt.Parse(row); err != nil {
+		return nil, err
+	}
+
+	var (
+		rv     = reflect.Indirect(reflect.ValueOf(row))
+		values = map[string]interface{}{}
+	)
+	for _, f := range stmt.Schema.Fields {
+		if f.DBName == "" || !f.Creatable {
+			continue
+		}
+		values[f.DBName], _ = f.ValueOf(context.Background(), rv)
+	}
+	return values, nil
+}
+
+// checkColumns returns what is wrong with inserting values into table,
+// whose column types are columns.
+func checkColumns(table string, columns map[string]string, values map[string]interface{}) []string {
+	var problems []string
+	for name, v := range values {
+		typ, ok := columns[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("column %s is not in %s", name, table))
+			continue
+		}
+		if !assignable(typ, v) {
+			problems = append(problems, fmt.Sprintf("column %s is %s, got %s", name, typ, describe(v)))
+		}
+	}
+	return problems
+}
+
+// plainValue dereferences pointers and driver.Valuer types such as
+// null.String down to the value sent to ClickHouse, nil for NULL.
+func plainValue(v interface{}) interface{} {
+	for v != nil {
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				return nil
+			}
+			v = rv.Elem().Interface()
+			continue
+		}
+
+		valuer, ok := v.(driver.Valuer)
+		if !ok {
+			return v
+		}
+		value, err := valuer.Value()
+		if err != nil || reflect.TypeOf(value) == reflect.TypeOf(v) {
+			return v
+		}
+		v = value
+	}
+	return nil
+}
+
+func describe(v interface{}) string {
+	if v = plainValue(v); v == nil {
+		return "NULL"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// unwrapType strips the LowCardinality and Nullable wrappers off a
+// ClickHouse type, reporting whether it is nullable.
+func unwrapType(typ string) (base string, nullable bool) {
+	for {
+		switch {
+		case strings.HasPrefix(typ, "LowCardinality(") && strings.HasSuffix(typ, ")"):
+			typ = typ[len("LowCardinality(") : len(typ)-1]
+		case strings.HasPrefix(typ, "Nullable(") && strings.HasSuffix(typ, ")"):
+			typ, nullable = typ[len("Nullable("):len(typ)-1], true
+		default:
+			return typ, nullable
+		}
+	}
+}
+
+// assignable reports whether v can be inserted into a column of ClickHouse
+// type typ. Types it does not know accept any value.
+func assignable(typ string, v interface{}) bool {
+	base, nullable := unwrapType(typ)
+
+	v = plainValue(v)
+	if v == nil {
+		return nullable
+	}
+	if _, ok := v.(time.Time); ok {
+		return strings.HasPrefix(base, "Date")
+	}
+
+	kind := reflect.TypeOf(v).Kind()
+	isBytes := kind == reflect.Slice && reflect.TypeOf(v).Elem().Kind() == reflect.Uint8
+	switch {
+	case strings.HasPrefix(base, "Int"), strings.HasPrefix(base, "UInt"):
+		return kind >= reflect.Int && kind <= reflect.Uint64 || kind == reflect.Bool
+	case strings.HasPrefix(base, "Float"), strings.HasPrefix(base, "Decimal"):
+		return kind >= reflect.Int && kind <= reflect.Float64
+	case base == "Bool":
+		return kind == reflect.Bool
+	case strings.HasPrefix(base, "String"), strings.HasPrefix(base, "FixedString"),
+		strings.HasPrefix(base, "UUID"), strings.HasPrefix(base, "Enum"):
+		return kind == reflect.String || isBytes
+	case strings.HasPrefix(base, "Date"):
+		return kind == reflect.String
+	case strings.HasPrefix(base, "Array"):
+		return kind == reflect.Slice && !isBytes || kind == reflect.Array
+	case strings.HasPrefix(base, "Map"):
+		return kind == reflect.Map
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"clickhouse-migrations/config"
+)
+
+// progress tracks how many source rows of a table a migration went through
+// and logs percent complete, throughput and ETA every progress.interval.
+type progress struct {
+	table   string
+	total   int64
+	resumed int64
+	done    atomic.Int64
+	start   time.Time
+	stop    chan struct{}
+}
+
+// sourceRows returns the number of rows to migrate: the planner estimate
+// of the Source table with progress.count estimate, when it has one and
+// the migration is not filtered, or an exact count otherwise.
+func (d *Definition[S, D]) sourceRows(ctx context.Context) (int64, error) {
+	switch mode := config.Config.Progress.Count; mode {
+	case "estimate":
+		// the planner estimate is of the whole table
+		if !filter.IsZero() {
+			break
+		}
+		if n, err := d.estimateRows(ctx); err != nil || n >= 0 {
+			return n, err
+		}
+	case "exact":
+	default:
+		return 0, fmt.Errorf("unknown progress count %q, expected estimate or exact", mode)
+	}
+
+	return d.count(ctx)
+}
+
+// estimateRows returns the planner estimate of the rows of the Source
+// table, or -1 if it has none.
+func (d *Definition[S, D]) estimateRows(ctx context.Context) (int64, error) {
+	if d.Source == "" {
+		return -1, nil
+	}
+
+	var n float64
+	err := db.Db.QueryRowContext(ctx, "select reltuples from pg_class where oid = $1::regclass", d.Source).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	// reltuples is -1 until the table is first vacuumed or analyzed
+	if n < 0 {
+		return -1, nil
+	}
+	return int64(n), nil
+}
+
+// startProgress counts the source rows and starts logging the progress of
+// a migration resuming from cps. The caller has to call finish.
+func (d *Definition[S, D]) startProgress(ctx context.Context, cps []*Checkpoint) *progress {
+	p := &progress{table: d.Table, start: time.Now(), stop: make(chan struct{})}
+	for _, cp := range cps {
+		p.resumed += cp.Read
+	}
+	p.done.Store(p.resumed)
+
+	total, err := d.sourceRows(ctx)
+	if err != nil {
+		slog.Warn("Count in postgres failed, progress is unknown", "table", d.Table, "error", err)
+	}
+	p.total = total
+	rowsRemaining.WithLabelValues(d.Table).Set(float64(p.remaining()))
+	slog.Info("Source rows counted", "table", d.Table, "source_rows", p.total, "resumed_rows", p.resumed)
+
+	if interval := time.Duration(config.Config.Progress.Interval) * time.Second; interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.log()
+				case <-p.stop:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	return p
+}
+
+// add records n more source rows gone through, inserted or not.
+func (p *progress) add(n int) {
+	p.done.Add(int64(n))
+	rowsRemaining.WithLabelValues(p.table).Set(float64(p.remaining()))
+}
+
+func (p *progress) remaining() int64 {
+	if r := p.total - p.done.Load(); r > 0 {
+		return r
+	}
+	return 0
+}
+
+func (p *progress) log() {
+	var (
+		done = p.done.Load()
+		rate = float64(done-p.resumed) / time.Since(p.start).Seconds()
+	)
+
+	if p.total <= 0 {
+		slog.Info("Progress", "table", p.table, "rows", done, "rows_per_second", math.Round(rate))
+		return
+	}
+
+	percent := 100 * float64(done) / float64(p.total)
+	if percent > 100 {
+		percent = 100
+	}
+	eta := "unknown"
+	if rate > 0 {
+		eta = (time.Duration(float64(p.remaining()) / rate * float64(time.Second))).Round(time.Second).String()
+	}
+	slog.Info("Progress", "table", p.table, "rows", done, "source_rows", p.total, "percent", math.Round(percent*10)/10,
+		"rows_per_second", math.Round(rate), "eta", eta)
+}
+
+func (p *progress) finish() {
+	close(p.stop)
+	p.log()
+}
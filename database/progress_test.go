@@ -0,0 +1,39 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"clickhouse-migrations/config"
+)
+
+func TestProgressResumed(t *testing.T) {
+	useTestEnv(t, &fakeSource{rows: testRows(30)})
+	config.Config.Progress.Interval = 0
+
+	// resumed ranges count the rows they read, like add does, not the ones
+	// they inserted
+	cps := []*Checkpoint{
+		{Range: "2023-04", Rows: 8, Read: 10, Done: true},
+		{Range: "2023-05", Rows: 3, Read: 5},
+		{Range: "2023-06"},
+	}
+	p := testDefinition(nil).startProgress(context.Background(), cps)
+	defer p.finish()
+
+	if p.total != 30 || p.resumed != 15 || p.done.Load() != 15 {
+		t.Fatalf("progress total %d, resumed %d, done %d, want 30, 15, 15", p.total, p.resumed, p.done.Load())
+	}
+	if got := p.remaining(); got != 15 {
+		t.Errorf("remaining() = %d, want 15", got)
+	}
+
+	p.add(12)
+	if got := p.remaining(); got != 3 {
+		t.Errorf("remaining() = %d after 12 more rows, want 3", got)
+	}
+	p.add(5)
+	if got := p.remaining(); got != 0 {
+		t.Errorf("remaining() = %d past the total, want 0", got)
+	}
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"fmt"
+)
+
+var migrators []Migrator
+
+func init() {
+	RegisterSchema(JobsSchema)
+	RegisterSchema(AuditsSchema)
+
+	Register(JobsMigration)
+	Register(AuditsMigration)
+}
+
+// Register adds m to the migrations the CLI can run. Migrations run in
+// registration order by "migrate all".
+func Register(m Migrator) {
+	if Lookup(m.Name()) != nil {
+		panic(fmt.Sprintf("migration %q registered twice", m.Name()))
+	}
+	migrators = append(migrators, m)
+}
+
+// Migrators returns every registered migration in registration order.
+func Migrators() []Migrator {
+	return migrators
+}
+
+// Lookup returns the migration registered as name, or nil.
+func Lookup(name string) Migrator {
+	for _, m := range migrators {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+)
+
+var (
+	_ Migrator = (*Definition[JobEntry, Job])(nil)
+	_ Migrator = (*Definition[AuditPG, Audit])(nil)
+)
+
+func TestRegistry(t *testing.T) {
+	defer func(registered []Migrator) { migrators = registered }(migrators)
+
+	var names []string
+	for _, m := range Migrators() {
+		names = append(names, m.Name())
+	}
+	if strings.Join(names, ",") != "jobs,audits" {
+		t.Errorf("Migrators() = %v, want jobs then audits", names)
+	}
+	if Lookup("jobs") != JobsMigration || Lookup("robots") != nil {
+		t.Errorf("Lookup() does not resolve registered names only")
+	}
+
+	robots := &Definition[testRow, testRow]{Table: "robots"}
+	Register(robots)
+	if Lookup("robots") != robots || Migrators()[2] != robots {
+		t.Errorf("Register() did not append robots")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering jobs twice did not panic")
+		}
+	}()
+	Register(&Definition[testRow, testRow]{Table: "jobs"})
+}
+
+func TestJobsConvert(t *testing.T) {
+	runAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	version := "v1"
+
+	tests := []struct {
+		name string
+		row  *JobEntry
+		err  string
+	}{
+		{
+			name: "converted",
+			row: &JobEntry{JobPG: JobPG{ID: "j1", RobotType: 2, RunAt: null.TimeFrom(runAt), StoppedAt: null.TimeFrom(runAt.Add(time.Minute)),
+				Status: "Success", Data: JSONB(`{"a":1}`)}, RobotName: "robot", FlowName: "flow", VersionName: &version},
+		},
+		{name: "no data", row: &JobEntry{JobPG: JobPG{ID: "j1", RunAt: null.TimeFrom(runAt)}}},
+		{name: "null run_at", row: &JobEntry{JobPG: JobPG{ID: "j1"}}, err: "run_at is null"},
+		{name: "invalid data", row: &JobEntry{JobPG: JobPG{ID: "j1", RunAt: null.TimeFrom(runAt), Data: JSONB(`{`)}}, err: "not valid json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, err := JobsMigration.Convert(tt.row)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Convert() error = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if job.ID != tt.row.ID || job.RobotType != int64(tt.row.RobotType) || !job.RunAt.Equal(runAt) ||
+				job.Data != string(tt.row.Data) || job.RobotName != tt.row.RobotName || job.IsDeleted {
+				t.Errorf("Convert() = %+v, want the fields of %+v", job, tt.row)
+			}
+			if tt.row.StoppedAt.Valid != (job.StoppedAt != nil) {
+				t.Errorf("StoppedAt = %v, want %v", job.StoppedAt, tt.row.StoppedAt)
+			}
+			if at, id := JobsMigration.Key(tt.row); !at.Time.Equal(runAt) || id != tt.row.ID {
+				t.Errorf("Key() = %v, %s, want run_at and id", at, id)
+			}
+		})
+	}
+}
+
+func TestAuditsConvert(t *testing.T) {
+	doneAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		row  *AuditPG
+		err  string
+	}{
+		{
+			name: "converted",
+			row: &AuditPG{ID: "a1", UserID: "u1", WorkspaceID: "w1", Category: "robot", Action: "update",
+				Data: []byte(`{}`), PreviousState: []byte(`{"a":1}`), NextState: []byte(`{"a":2}`), DoneAt: null.TimeFrom(doneAt)},
+		},
+		{name: "null done_at", row: &AuditPG{ID: "a1"}, err: "done_at is null"},
+		{name: "invalid state", row: &AuditPG{ID: "a1", DoneAt: null.TimeFrom(doneAt), NextState: []byte(`{`)},
+			err: "next_state is not valid json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audit, err := AuditsMigration.Convert(tt.row)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Convert() error = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audit.ID != "a1" || audit.UserID != "u1" || audit.WorkspaceID != "w1" || !audit.CreatedAt.Equal(doneAt) ||
+				string(audit.NextState) != `{"a":2}` {
+				t.Errorf("Convert() = %+v, want the fields of %+v", audit, tt.row)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Repair reads the source rows keyed in [from, to), drops those whose id
+// is already in ClickHouse and inserts the rest with the regular scan and
+// conversion. Rows are not checkpointed; rerunning a repair is safe since
+// it only ever inserts ids that are missing.
+func (d *Definition[S, D]) Repair(ctx context.Context, from, to time.Time) (inserted int64, err error) {
+	ctx, span := startTable(ctx, "repair", d.Table, d.Destination)
+	reportTable(d.Table)
+	defer func() {
+		span.SetAttributes(attribute.Int64("rows", inserted))
+		finishReport(d.Table, err)
+		endSpan(span, err)
+	}()
+
+	if s := LookupSchema(d.Destination); s != nil {
+		if err := s.Check(); err != nil {
+			return 0, err
+		}
+	}
+
+	var ids []string
+	query := fmt.Sprintf(`select toString(%s) from %s final where %s >= ? and %s < ?`,
+		d.DestKeyID, d.Destination, d.DestKeyAt, d.DestKeyAt)
+	if err := ch.WithContext(ctx).Raw(query, from, to).Scan(&ids).Error; err != nil {
+		return 0, fmt.Errorf("Repair %s failed reading clickhouse ids: %s", d.Table, err.Error())
+	}
+
+	present := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		present[id] = struct{}{}
+	}
+	ids = nil
+	slog.Info("Repair found rows already in ClickHouse", "table", d.Table, "rows", len(present))
+
+	ranges, err := d.restrict([]*keyRange{{Name: "repair", From: from, To: to}})
+	if err != nil || len(ranges) == 0 {
+		return 0, err
+	}
+	return d.copyRange(ctx, "Repair", ranges[0], func(id string) bool {
+		_, ok := present[id]
+		return ok
+	})
+}
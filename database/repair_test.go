@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"clickhouse-migrations/config"
+)
+
+func TestCopyRange(t *testing.T) {
+	source := testRows(12, "", "", "bad2")
+	at := func(i int) time.Time { return source[i].At }
+
+	tests := []struct {
+		name     string
+		r        *keyRange
+		present  []string
+		inserted []string
+	}{
+		{name: "all missing", r: &keyRange{Name: "repair"}, inserted: ids(source, 0, 12)},
+		{
+			name:     "present ids skipped",
+			r:        &keyRange{Name: "repair"},
+			present:  []string{"r000", "r005", "r006", "r011"},
+			inserted: []string{"r001", "r003", "r004", "r007", "r008", "r009", "r010"},
+		},
+		{
+			name:     "key range",
+			r:        &keyRange{Name: "repair", From: at(4), To: at(9)},
+			present:  []string{"r005"},
+			inserted: []string{"r004", "r006", "r007", "r008"},
+		},
+		{name: "everything present", r: &keyRange{Name: "repair", From: at(0), To: at(2)}, present: []string{"r000", "r001"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestEnv(t, &fakeSource{rows: source})
+			cfg := &config.Config.Migration
+			cfg.PageSize, cfg.BatchSize = 4, 3
+
+			present := make(map[string]bool)
+			for _, id := range tt.present {
+				present[id] = true
+			}
+
+			var inserted [][]*testRow
+			copied, err := testDefinition(&inserted).copyRange(context.Background(), "Repair", tt.r,
+				func(id string) bool { return present[id] })
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, b := range inserted {
+				for _, r := range b {
+					got = append(got, r.ID)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.inserted) {
+				t.Errorf("inserted %v, want %v", got, tt.inserted)
+			}
+			if copied != int64(len(tt.inserted)) {
+				t.Errorf("copyRange() = %d, want %d", copied, len(tt.inserted))
+			}
+
+			// copies never checkpoint, so a repair can run beside a migration
+			cps, err := checkpoints.Load("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cps) != 0 {
+				t.Errorf("stored %d checkpoints, want none", len(cps))
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// RunReport summarizes one run of the tool, written as JSON at exit when
+// progress.report is set. Status is completed, failed or interrupted.
+type RunReport struct {
+	RunID      string         `json:"run_id"`
+	Command    []string       `json:"command"`
+	Filter     string         `json:"filter,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Tables     []*TableReport `json:"tables"`
+}
+
+// TableReport counts what the run did to one table. Rows are the rows this
+// run inserted, SourceRows the rows migrate counted or estimated up front.
+type TableReport struct {
+	Table       string        `json:"table"`
+	SourceRows  int64         `json:"source_rows,omitempty"`
+	Rows        int64         `json:"rows"`
+	DeadLetters int64         `json:"dead_letters"`
+	Seconds     float64       `json:"seconds"`
+	Error       string        `json:"error,omitempty"`
+	Checkpoints []*Checkpoint `json:"checkpoints,omitempty"`
+
+	start time.Time
+}
+
+var (
+	reportMu sync.Mutex
+	report   = &RunReport{RunID: runID, StartedAt: time.Now()}
+)
+
+// reportTable returns the report of table, adding it on first use.
+func reportTable(table string) *TableReport {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+
+	for _, t := range report.Tables {
+		if t.Table == table {
+			return t
+		}
+	}
+	t := &TableReport{Table: table, start: time.Now()}
+	report.Tables = append(report.Tables, t)
+	return t
+}
+
+// updateReport changes the report of table under the report lock.
+func updateReport(table string, fn func(t *TableReport)) {
+	t := reportTable(table)
+
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	fn(t)
+}
+
+// finishReport records the time spent on table and the error it failed
+// with, if any.
+func finishReport(table string, err error) {
+	updateReport(table, func(t *TableReport) {
+		t.Seconds = time.Since(t.start).Seconds()
+		if err != nil {
+			t.Error = err.Error()
+		}
+	})
+}
+
+// countWritten records n rows of table inserted into ClickHouse.
+func countWritten(table string, n int) {
+	rowsWritten.WithLabelValues(table).Add(float64(n))
+	updateReport(table, func(t *TableReport) { t.Rows += int64(n) })
+}
+
+// runStatus returns the status of a run that ended with err: completed,
+// failed or interrupted.
+func runStatus(err error, interrupted bool) string {
+	switch {
+	case interrupted:
+		return "interrupted"
+	case err != nil:
+		return "failed"
+	}
+	return "completed"
+}
+
+// WriteReport writes the run report to path, "-" meaning stdout.
+func WriteReport(path string, command []string, err error, interrupted bool) error {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+
+	report.Command = command
+	report.FinishedAt = time.Now()
+	report.Status = runStatus(err, interrupted)
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"clickhouse-migrations/config"
+)
+
+// retryableCHCodes are ClickHouse exception codes of transient failures.
+// Every other exception, e.g. an unknown table or column or a type
+// mismatch, fails the same way on every attempt.
+var retryableCHCodes = map[int32]bool{
+	3:   true, // UNEXPECTED_END_OF_FILE
+	159: true, // TIMEOUT_EXCEEDED
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	241: true, // MEMORY_LIMIT_EXCEEDED
+	242: true, // TABLE_IS_READ_ONLY
+	252: true, // TOO_MANY_PARTS
+	319: true, // UNKNOWN_STATUS_OF_INSERT
+	425: true, // SYSTEM_ERROR
+	999: true, // KEEPER_EXCEPTION
+}
+
+// retryablePGCode reports whether a Postgres SQLSTATE is transient:
+// connection exceptions, insufficient resources, operator intervention
+// such as a server shutdown, and serialization failures or deadlocks.
+func retryablePGCode(code string) bool {
+	switch {
+	case len(code) < 2:
+		return false
+	case code[:2] == "08", code[:2] == "53":
+		return true
+	}
+	switch code {
+	case "57P01", "57P02", "57P03", "40001", "40P01":
+		return true
+	}
+	return false
+}
+
+// retryable reports whether err is a network or server side failure that
+// may succeed when tried again, as opposed to a schema or data error.
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	for _, target := range []error{driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded,
+		syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EPIPE} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	var (
+		netErr net.Error
+		pqErr  *pq.Error
+		chErr  *clickhouse.Exception
+	)
+	switch {
+	case errors.As(err, &netErr):
+		return true
+	case errors.As(err, &pqErr):
+		return retryablePGCode(string(pqErr.Code))
+	case errors.As(err, &chErr):
+		return retryableCHCodes[chErr.Code]
+	}
+	return false
+}
+
+// backoff returns the wait before attempt+1: retry.initial doubled per
+// attempt up to retry.max, with the upper half randomized so concurrent
+// workers do not retry in lockstep.
+func backoff(attempt int) time.Duration {
+	var (
+		cfg = config.Config.Retry
+		d   = time.Duration(cfg.Initial) * time.Millisecond
+		max = time.Duration(cfg.Max) * time.Millisecond
+	)
+
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Retry calls fn until it succeeds or fails with an error that is not
+// retryable, at most retry.attempts times and, when retry.elapsed is set,
+// not after that many seconds. The last error is returned, or ctx.Err()
+// once ctx is cancelled.
+func Retry(ctx context.Context, op string, fn func() error) error {
+	var (
+		cfg     = config.Config.Retry
+		start   = time.Now()
+		elapsed = time.Duration(cfg.Elapsed) * time.Second
+	)
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retryable(err) {
+			return err
+		}
+		if cfg.Attempts > 0 && attempt >= cfg.Attempts {
+			slog.Error("Retries exhausted", "op", op, "attempt", attempt, "error", err)
+			return err
+		}
+
+		wait := backoff(attempt)
+		if elapsed > 0 && time.Since(start)+wait > elapsed {
+			slog.Error("Retries exhausted", "op", op, "attempt", attempt, "elapsed", time.Since(start).Round(time.Second), "error", err)
+			return err
+		}
+
+		retries.Inc()
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.String("op", op),
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+		slog.Warn("Retrying", "op", op, "attempt", attempt, "wait", wait.Round(time.Millisecond), "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
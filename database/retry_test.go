@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/lib/pq"
+
+	"clickhouse-migrations/config"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil},
+		{name: "cancelled", err: context.Canceled},
+		{name: "deadline", err: context.DeadlineExceeded, want: true},
+		{name: "bad conn", err: driver.ErrBadConn, want: true},
+		{name: "wrapped eof", err: fmt.Errorf("read: %w", io.EOF), want: true},
+		{name: "connection reset", err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}, want: true},
+		{name: "postgres connection failure", err: &pq.Error{Code: "08006"}, want: true},
+		{name: "postgres admin shutdown", err: &pq.Error{Code: "57P01"}, want: true},
+		{name: "postgres serialization failure", err: &pq.Error{Code: "40001"}, want: true},
+		{name: "postgres undefined column", err: &pq.Error{Code: "42703"}},
+		{name: "clickhouse too many parts", err: &clickhouse.Exception{Code: 252}, want: true},
+		{name: "wrapped clickhouse timeout", err: fmt.Errorf("insert: %w", &clickhouse.Exception{Code: 159}), want: true},
+		{name: "clickhouse unknown table", err: &clickhouse.Exception{Code: 60}},
+		{name: "plain error", err: errors.New("type mismatch")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	config.Config = config.Default
+	defer func(retry config.Retry) { config.Config.Retry = retry }(config.Config.Retry)
+
+	tests := []struct {
+		name     string
+		initial  int
+		max      int
+		attempt  int
+		min, cap time.Duration
+	}{
+		{name: "first", initial: 100, max: 10_000, attempt: 1, min: 50 * time.Millisecond, cap: 100 * time.Millisecond},
+		{name: "doubled", initial: 100, max: 10_000, attempt: 3, min: 200 * time.Millisecond, cap: 400 * time.Millisecond},
+		{name: "capped", initial: 100, max: 1_000, attempt: 10, min: 500 * time.Millisecond, cap: time.Second},
+		{name: "max below initial", initial: 1_000, max: 300, attempt: 1, min: 150 * time.Millisecond, cap: 300 * time.Millisecond},
+		{name: "disabled", initial: 0, max: 1_000, attempt: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.Retry.Initial, config.Config.Retry.Max = tt.initial, tt.max
+			for i := 0; i < 100; i++ {
+				if d := backoff(tt.attempt); d < tt.min || d > tt.cap {
+					t.Fatalf("backoff(%d) = %s, want within [%s, %s]", tt.attempt, d, tt.min, tt.cap)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	config.Config = config.Default
+	defer func(retry config.Retry) { config.Config.Retry = retry }(config.Config.Retry)
+	config.Config.Retry = config.Retry{Attempts: 0, Initial: 60000, Max: 60000}
+
+	// a cancelled wait returns at once instead of retrying
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := Retry(ctx, "op", func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("Retry() = %v after %d calls, want context.Canceled after 1", err, calls)
+	}
+
+	// an error after cancellation is not retried
+	calls = 0
+	err = Retry(ctx, "op", func() error {
+		calls++
+		return io.EOF
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("Retry() = %v after %d calls, want context.Canceled after 1", err, calls)
+	}
+}
@@ -0,0 +1,276 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// TableSchema is a versioned definition of a ClickHouse destination table.
+// Bump Version whenever the definition changes; the applied version is kept
+// in the table comment.
+type TableSchema struct {
+	Name        string
+	Version     int
+	Columns     []*ColumnSchema
+	Engine      string
+	PartitionBy string
+	OrderBy     string
+	TTL         string
+	// Settings are table settings such as "a = 1, b = 2", set on create
+	// and whenever Version is bumped.
+	Settings string
+}
+
+type ColumnSchema struct {
+	Name  string
+	Type  string
+	Codec string
+}
+
+// tableInfo and columnInfo are rows of system.tables and system.columns.
+type tableInfo struct {
+	EngineFull   string
+	SortingKey   string
+	PartitionKey string
+	Comment      string
+}
+
+type columnInfo struct {
+	Name             string
+	Type             string
+	CompressionCodec string
+}
+
+var schemas []*TableSchema
+
+// RegisterSchema adds s to the tables managed by "schema apply" and
+// checked before migrating into them.
+func RegisterSchema(s *TableSchema) {
+	if LookupSchema(s.Name) != nil {
+		panic(fmt.Sprintf("schema %q registered twice", s.Name))
+	}
+	schemas = append(schemas, s)
+}
+
+func Schemas() []*TableSchema {
+	return schemas
+}
+
+// LookupSchema returns the schema of the ClickHouse table name, or nil.
+func LookupSchema(name string) *TableSchema {
+	for _, s := range schemas {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func schemaComment(version int) string {
+	return fmt.Sprintf("clickhouse-migrations schema version %d", version)
+}
+
+func parseSchemaComment(comment string) int {
+	var version int
+	fmt.Sscanf(comment, "clickhouse-migrations schema version %d", &version)
+	return version
+}
+
+// normalize makes ClickHouse expressions comparable regardless of spacing,
+// case and outer parentheses.
+func normalize(expr string) string {
+	expr = strings.ToLower(strings.Join(strings.Fields(expr), ""))
+	for enclosed(expr) {
+		expr = expr[1 : len(expr)-1]
+	}
+	return expr
+}
+
+// enclosed reports whether one pair of parentheses wraps all of expr.
+func enclosed(expr string) bool {
+	if !strings.HasPrefix(expr, "(") || !strings.HasSuffix(expr, ")") {
+		return false
+	}
+	depth := 0
+	for i, r := range expr {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i < len(expr)-1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// engineOf returns the engine with its parameters from an engine_full
+// value, e.g. "ReplacingMergeTree(updated_at)".
+func engineOf(engineFull string) string {
+	end := len(engineFull)
+	for _, clause := range []string{" PARTITION BY ", " PRIMARY KEY ", " ORDER BY ", " SAMPLE BY ", " TTL ", " SETTINGS "} {
+		if i := strings.Index(engineFull, clause); i >= 0 && i < end {
+			end = i
+		}
+	}
+	return engineFull[:end]
+}
+
+func (c *ColumnSchema) definition() string {
+	if c.Codec == "" {
+		return fmt.Sprintf("%s %s", c.Name, c.Type)
+	}
+	return fmt.Sprintf("%s %s CODEC(%s)", c.Name, c.Type, c.Codec)
+}
+
+// CreateSQL returns the statement creating the table from scratch.
+func (s *TableSchema) CreateSQL() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "create table if not exists %s (\n", s.Name)
+	for i, c := range s.Columns {
+		sep := ","
+		if i == len(s.Columns)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(&b, "\t%s%s\n", c.definition(), sep)
+	}
+	fmt.Fprintf(&b, ") engine = %s", s.Engine)
+	if s.PartitionBy != "" {
+		fmt.Fprintf(&b, "\npartition by %s", s.PartitionBy)
+	}
+	fmt.Fprintf(&b, "\norder by %s", s.OrderBy)
+	if s.TTL != "" {
+		fmt.Fprintf(&b, "\nttl %s", s.TTL)
+	}
+	if s.Settings != "" {
+		fmt.Fprintf(&b, "\nsettings %s", s.Settings)
+	}
+	fmt.Fprintf(&b, "\ncomment '%s'", schemaComment(s.Version))
+
+	return b.String()
+}
+
+func (s *TableSchema) info() (*tableInfo, error) {
+	var infos []*tableInfo
+	err := ch.Raw(`select engine_full, sorting_key, partition_key, comment from system.tables
+		where database = currentDatabase() and name = ?`, s.Name).Scan(&infos).Error
+	if err != nil || len(infos) == 0 {
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+// Check returns an error if the table is missing or its engine, sorting
+// key or partition key differ from s. Those cannot be altered in place, so
+// migrating into such a table would silently break deduplication.
+func (s *TableSchema) Check() error {
+	info, err := s.info()
+	if err != nil {
+		return fmt.Errorf("Check %s schema failed: %s", s.Name, err.Error())
+	}
+	if info == nil {
+		return fmt.Errorf("ClickHouse table %s does not exist, run \"schema apply\" first", s.Name)
+	}
+
+	var diffs []string
+	if got := engineOf(info.EngineFull); normalize(got) != normalize(s.Engine) {
+		diffs = append(diffs, fmt.Sprintf("engine is %s, expected %s", got, s.Engine))
+	}
+	if normalize(info.SortingKey) != normalize(s.OrderBy) {
+		diffs = append(diffs, fmt.Sprintf("order by is (%s), expected %s", info.SortingKey, s.OrderBy))
+	}
+	if normalize(info.PartitionKey) != normalize(s.PartitionBy) {
+		diffs = append(diffs, fmt.Sprintf("partition by is %s, expected %s", info.PartitionKey, s.PartitionBy))
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("ClickHouse table %s does not match its schema: %s", s.Name, strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// Plan returns the statements bringing the table to s: a create if it is
+// missing, otherwise the column, TTL, settings and comment alters it needs.
+func (s *TableSchema) Plan() ([]string, error) {
+	info, err := s.info()
+	if err != nil {
+		return nil, fmt.Errorf("Plan %s schema failed: %s", s.Name, err.Error())
+	}
+	if info == nil {
+		return []string{s.CreateSQL()}, nil
+	}
+
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+
+	applied := parseSchemaComment(info.Comment)
+	if applied > s.Version {
+		return nil, fmt.Errorf("ClickHouse table %s has schema version %d, newer than %d", s.Name, applied, s.Version)
+	}
+
+	var columns []*columnInfo
+	err = ch.Raw(`select name, type, compression_codec from system.columns
+		where database = currentDatabase() and table = ?`, s.Name).Scan(&columns).Error
+	if err != nil {
+		return nil, fmt.Errorf("Plan %s schema failed: %s", s.Name, err.Error())
+	}
+
+	existing := map[string]*columnInfo{}
+	for _, c := range columns {
+		existing[c.Name] = c
+	}
+
+	var stmts []string
+	for _, c := range s.Columns {
+		e, ok := existing[c.Name]
+		switch {
+		case !ok:
+			stmts = append(stmts, fmt.Sprintf("alter table %s add column %s", s.Name, c.definition()))
+		case normalize(e.Type) != normalize(c.Type) || normalize(e.CompressionCodec) != normalize(codecOf(c)):
+			stmts = append(stmts, fmt.Sprintf("alter table %s modify column %s", s.Name, c.definition()))
+		}
+		delete(existing, c.Name)
+	}
+	for name := range existing {
+		slog.Warn("ClickHouse table has a column which is not in its schema", "table", s.Name, "column", name)
+	}
+
+	if applied < s.Version {
+		if s.TTL != "" {
+			stmts = append(stmts, fmt.Sprintf("alter table %s modify ttl %s", s.Name, s.TTL))
+		}
+		if s.Settings != "" {
+			stmts = append(stmts, fmt.Sprintf("alter table %s modify setting %s", s.Name, s.Settings))
+		}
+		stmts = append(stmts, fmt.Sprintf("alter table %s modify comment '%s'", s.Name, schemaComment(s.Version)))
+	}
+
+	return stmts, nil
+}
+
+func codecOf(c *ColumnSchema) string {
+	if c.Codec == "" {
+		return ""
+	}
+	return "CODEC(" + c.Codec + ")"
+}
+
+// Apply runs the statements returned by Plan and returns them.
+func (s *TableSchema) Apply() ([]string, error) {
+	stmts, err := s.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range stmts {
+		if err := ch.Exec(stmt).Error; err != nil {
+			return nil, fmt.Errorf("Apply %s schema failed: %s", s.Name, err.Error())
+		}
+	}
+	return stmts, nil
+}
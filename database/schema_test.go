@@ -0,0 +1,81 @@
+package database
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{expr: "(workspace_id, id)", want: "workspace_id,id"},
+		{expr: "workspace_id, id", want: "workspace_id,id"},
+		{expr: "((workspace_id,  ID))", want: "workspace_id,id"},
+		{expr: "toYYYYMM(run_at)", want: "toyyyymm(run_at)"},
+		{expr: "(toYYYYMM(run_at))", want: "toyyyymm(run_at)"},
+		{expr: "(a) + (b)", want: "(a)+(b)"},
+		{expr: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := normalize(tt.expr); got != tt.want {
+				t.Errorf("normalize(%q) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnclosed(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: "(a,b)", want: true},
+		{expr: "((a),(b))", want: true},
+		{expr: "(a)+(b)"},
+		{expr: "f(a)"},
+		{expr: "(a"},
+		{expr: "a"},
+		{expr: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := enclosed(tt.expr); got != tt.want {
+				t.Errorf("enclosed(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineOf(t *testing.T) {
+	tests := []struct {
+		engineFull string
+		want       string
+	}{
+		{
+			engineFull: "ReplacingMergeTree(updated_at) PARTITION BY toYYYYMM(run_at) ORDER BY (workspace_id, id) SETTINGS index_granularity = 8192",
+			want:       "ReplacingMergeTree(updated_at)",
+		},
+		{
+			engineFull: "ReplacingMergeTree ORDER BY (workspace_id, id) SETTINGS index_granularity = 8192",
+			want:       "ReplacingMergeTree",
+		},
+		{
+			engineFull: "MergeTree PRIMARY KEY id ORDER BY (id, at) TTL at + toIntervalDay(30)",
+			want:       "MergeTree",
+		},
+		{
+			engineFull: "Memory",
+			want:       "Memory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := engineOf(tt.engineFull); got != tt.want {
+				t.Errorf("engineOf(%q) = %q, want %q", tt.engineFull, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gorp "gopkg.in/gorp.v1"
+	null "gopkg.in/guregu/null.v3"
+
+	"clickhouse-migrations/config"
+)
+
+// testRow is the source and destination row of testDefinition.
+type testRow struct {
+	At time.Time `json:"at"`
+	ID string    `json:"id"`
+}
+
+// testDefinition migrates testRows keyed by (at, id). Rows whose id starts
+// with "bad" fail to convert and rows whose id starts with "drop" convert
+// to nothing. Batches are appended to *inserted.
+func testDefinition(inserted *[][]*testRow) *Definition[testRow, testRow] {
+	var mu sync.Mutex
+	return &Definition[testRow, testRow]{
+		Table:       "test",
+		Destination: "test",
+		Query:       "select at, id from test where %s limit %d",
+		KeyAt:       "at",
+		KeyID:       "id",
+		Bounds:      "select min(at), max(at) from test",
+		Count:       "select count(*) from test",
+		Scan: func(rows *sql.Rows) (*testRow, error) {
+			r := &testRow{}
+			return r, rows.Scan(&r.At, &r.ID)
+		},
+		Key: func(r *testRow) (null.Time, string) {
+			return null.TimeFrom(r.At), r.ID
+		},
+		Convert: func(r *testRow) (*testRow, error) {
+			switch {
+			case strings.HasPrefix(r.ID, "bad"):
+				return nil, errors.New("bad row")
+			case strings.HasPrefix(r.ID, "drop"):
+				return nil, nil
+			}
+			return r, nil
+		},
+		Insert: func(ctx context.Context, rows []*testRow) error {
+			mu.Lock()
+			defer mu.Unlock()
+			*inserted = append(*inserted, rows)
+			return nil
+		},
+	}
+}
+
+// testRows returns n rows a second apart with the given ids, or numbered
+// ones where ids has none.
+func testRows(n int, ids ...string) []*testRow {
+	rows := make([]*testRow, n)
+	for i := range rows {
+		id := fmt.Sprintf("r%03d", i)
+		if i < len(ids) && ids[i] != "" {
+			id = ids[i]
+		}
+		rows[i] = &testRow{At: time.Date(2023, 5, 1, 0, 0, i, 0, time.UTC), ID: id}
+	}
+	return rows
+}
+
+// useTestEnv points the package at a fake source serving rows, file
+// checkpoint and dead letter stores in a temp dir and the default config,
+// for the duration of the test.
+func useTestEnv(t *testing.T, src *fakeSource) {
+	t.Helper()
+	saved := *config.Default
+	config.Config = config.Default
+	dir := t.TempDir()
+	checkpoints = &fileCheckpointStore{path: filepath.Join(dir, "checkpoints.json")}
+	deadLetters = &fileDeadLetterStore{path: filepath.Join(dir, "dead_letters.ndjson")}
+	db = &gorp.DbMap{Db: sql.OpenDB(src), Dialect: gorp.PostgresDialect{}}
+	t.Cleanup(func() {
+		*config.Default = saved
+		checkpoints, deadLetters = nil, nil
+		db.Db.Close()
+		db = nil
+	})
+}
+
+// fakeSource is a Postgres connector serving the Bounds, Count and keyset
+// page queries of testDefinition from rows, sorted by key, and now() from
+// now. before, if set, is called with the index in the page of every row
+// before it is returned.
+type fakeSource struct {
+	rows   []*testRow
+	now    time.Time
+	before func(i int)
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (s *fakeSource) Connect(context.Context) (driver.Conn, error) { return &fakeConn{src: s}, nil }
+func (s *fakeSource) Driver() driver.Driver                        { return nil }
+
+// pages returns how many page queries were run.
+func (s *fakeSource) pages() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, q := range s.queries {
+		if strings.HasPrefix(q, "select at, id") {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *fakeSource) query(query string, args []driver.NamedValue) (driver.Rows, error) {
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "select min(at), max(at)"):
+		if len(s.rows) == 0 {
+			return &fakeRows{columns: []string{"min", "max"}, values: [][]driver.Value{{nil, nil}}}, nil
+		}
+		return &fakeRows{columns: []string{"min", "max"},
+			values: [][]driver.Value{{s.rows[0].At, s.rows[len(s.rows)-1].At}}}, nil
+	case query == "select now()":
+		return &fakeRows{columns: []string{"now"}, values: [][]driver.Value{{s.now}}}, nil
+	case strings.HasPrefix(query, "select count(*)"):
+		return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(len(s.rows))}}}, nil
+	case strings.HasPrefix(query, "select at, id"):
+	default:
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+
+	var (
+		where = query[strings.Index(query, " where ")+len(" where ") : strings.LastIndex(query, " limit ")]
+		conds []func(r *testRow) bool
+	)
+	limit, err := strconv.Atoi(query[strings.LastIndex(query, " ")+1:])
+	if err != nil {
+		return nil, err
+	}
+	arg := func(n string) interface{} {
+		i, _ := strconv.Atoi(strings.TrimPrefix(n, "$"))
+		return args[i-1].Value
+	}
+	for _, cond := range strings.Split(where, " and ") {
+		var a, b string
+		switch {
+		case cond == "at is not null":
+		case cond == "at is null":
+			// testRows always have a key timestamp
+			conds = append(conds, func(*testRow) bool { return false })
+		case scan(cond, "(at, id) > (%s %s", &a, &b):
+			after := Key{At: arg(strings.TrimSuffix(a, ",")).(time.Time), ID: arg(strings.TrimSuffix(b, ")")).(string)}
+			conds = append(conds, func(r *testRow) bool {
+				return r.At.After(after.At) || r.At.Equal(after.At) && r.ID > after.ID
+			})
+		case scan(cond, "(at >= %s", &a):
+			since := arg(strings.TrimSuffix(a, ")")).(time.Time)
+			conds = append(conds, func(r *testRow) bool { return !r.At.Before(since) })
+		case scan(cond, "at >= %s", &a):
+			from := arg(a).(time.Time)
+			conds = append(conds, func(r *testRow) bool { return !r.At.Before(from) })
+		case scan(cond, "at < %s", &a):
+			to := arg(a).(time.Time)
+			conds = append(conds, func(r *testRow) bool { return r.At.Before(to) })
+		default:
+			return nil, fmt.Errorf("unexpected condition %q", cond)
+		}
+	}
+
+	rows := &fakeRows{columns: []string{"at", "id"}, before: s.before}
+rows:
+	for _, r := range s.rows {
+		for _, cond := range conds {
+			if !cond(r) {
+				continue rows
+			}
+		}
+		if len(rows.values) == limit {
+			break
+		}
+		rows.values = append(rows.values, []driver.Value{r.At, r.ID})
+	}
+	return rows, nil
+}
+
+// scan reports whether cond matches format, storing its verbs in args.
+func scan(cond, format string, args ...interface{}) bool {
+	n, err := fmt.Sscanf(cond, format, args...)
+	return err == nil && n == len(args)
+}
+
+type fakeConn struct {
+	src *fakeSource
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.src.query(query, args)
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+	before  func(i int)
+	next    int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next == len(r.values) {
+		return io.EOF
+	}
+	if r.before != nil {
+		r.before(r.next)
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type TableStatus struct {
+	Table       string `json:"table"`
+	Source      int64  `json:"source"`
+	Destination int64  `json:"destination"`
+}
+
+// Missing returns how many source rows are not yet in ClickHouse.
+func (s *TableStatus) Missing() int64 {
+	return s.Source - s.Destination
+}
+
+// Status counts the rows every registered migration would copy from
+// Postgres and the rows already present in its ClickHouse table, both
+// under the filter.
+func Status(ctx context.Context) ([]*TableStatus, error) {
+	var statuses []*TableStatus
+	for _, m := range Migrators() {
+		s, err := m.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+
+	return statuses, nil
+}
+
+func (d *Definition[S, D]) Status(ctx context.Context) (*TableStatus, error) {
+	s := &TableStatus{Table: d.Table}
+
+	var err error
+	if s.Source, err = d.count(ctx); err != nil {
+		return nil, fmt.Errorf("Count %s in postgres failed: %s", d.Table, err.Error())
+	}
+
+	cond, args, err := d.destFilter()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.WithContext(ctx).Raw(d.destCount(cond), args...).Scan(&s.Destination).Error; err != nil {
+		return nil, fmt.Errorf("Count %s in clickhouse failed: %s", d.Table, err.Error())
+	}
+
+	return s, nil
+}
+
+// destCount returns the query counting the destination rows under cond,
+// which may be empty. Rows are counted once their versions are collapsed
+// and deleted ones left out, as a Verification does, so rows inserted
+// again or deleted by sync do not inflate the count.
+func (d *Definition[S, D]) destCount(cond string) string {
+	var conds []string
+	if d.DestDeleted != "" {
+		conds = append(conds, "not "+d.DestDeleted)
+	}
+	if cond != "" {
+		conds = append(conds, cond)
+	}
+
+	query := fmt.Sprintf("select count() from %s final", d.Destination)
+	if len(conds) > 0 {
+		query += " where " + strings.Join(conds, " and ")
+	}
+	return query
+}
@@ -0,0 +1,43 @@
+package database
+
+import "testing"
+
+func TestDestCount(t *testing.T) {
+	tests := []struct {
+		name string
+		def  *Definition[struct{}, struct{}]
+		cond string
+		want string
+	}{
+		{
+			name: "whole table",
+			def:  &Definition[struct{}, struct{}]{Destination: "audits"},
+			want: "select count() from audits final",
+		},
+		{
+			name: "filtered",
+			def:  &Definition[struct{}, struct{}]{Destination: "audits"},
+			cond: "created_at >= ?",
+			want: "select count() from audits final where created_at >= ?",
+		},
+		{
+			name: "deleted rows",
+			def:  &Definition[struct{}, struct{}]{Destination: "jobs", DestDeleted: "is_deleted"},
+			want: "select count() from jobs final where not is_deleted",
+		},
+		{
+			name: "filtered deleted rows",
+			def:  &Definition[struct{}, struct{}]{Destination: "jobs", DestDeleted: "is_deleted"},
+			cond: "run_at >= ?",
+			want: "select count() from jobs final where not is_deleted and run_at >= ?",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.def.destCount(tt.cond); got != tt.want {
+				t.Errorf("destCount(%q) = %q, want %q", tt.cond, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/lib/pq"
+
+	"clickhouse-migrations/config"
+)
+
+// syncCheckpoint names the checkpoints holding the applied LSN of a slot.
+const syncCheckpoint = "sync"
+
+// syncTable applies the changes of one replicated Postgres table. Both
+// functions get the primary keys changed by one committed transaction and
+// its commit time, which versions the rows they write: the version follows
+// the source change rather than when sync got to it, so a lagging or
+// restarted sync does not outrank rows copied since.
+type syncTable struct {
+	upsert func(ctx context.Context, ids []string, at time.Time) error
+	remove func(ctx context.Context, ids []string, at time.Time) error
+}
+
+var syncTables = map[string]*syncTable{
+	"workspace.jobs":  {upsert: upsertJobs, remove: removeJobs},
+	"workspace.audit": {upsert: upsertAudits, remove: removeAudits},
+}
+
+// fetch selects the source rows with the given ids and converts them.
+// Rows the source query filters out, or that are gone by now, are skipped.
+func (d *Definition[S, D]) fetch(ctx context.Context, ids []string) ([]*D, error) {
+	var rows []*D
+
+	query := fmt.Sprintf(d.Query, d.KeyID+" = any($1)", len(ids))
+	err := Retry(ctx, fmt.Sprintf("Read %s", d.Table), func() error {
+		rows = rows[:0]
+		_, err := d.page(ctx, query, []interface{}{pq.Array(ids)}, func(row *S) error {
+			out, err := d.Convert(row)
+			if err != nil {
+				if err := d.reject(ctx, stageConvert, row, err); err != nil {
+					return fmt.Errorf("Sync %s failed on convert: %s", d.Table, err.Error())
+				}
+				return nil
+			}
+			if out != nil {
+				rows = append(rows, out)
+			}
+			return nil
+		})
+		return err
+	})
+	return rows, err
+}
+
+// upsertJobs reads the current state of changed jobs and inserts it as a
+// new version, like Job.Update.
+func upsertJobs(ctx context.Context, ids []string, at time.Time) error {
+	jobs, err := JobsMigration.fetch(ctx, ids)
+	if err != nil || len(jobs) == 0 {
+		return err
+	}
+
+	for _, j := range jobs {
+		j.touch(at)
+	}
+	_, err = JobsMigration.write(ctx, jobs)
+	return err
+}
+
+// removeJobs inserts a deleted version of the latest row of every deleted
+// job, like Job.Delete.
+func removeJobs(ctx context.Context, ids []string, at time.Time) error {
+	var jobs []*Job
+	if err := ch.WithContext(ctx).Raw("select * from jobs final where id in ?", ids).Scan(&jobs).Error; err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	for _, j := range jobs {
+		j.markDeleted(at)
+	}
+	_, err := JobsMigration.write(ctx, jobs)
+	return err
+}
+
+// upsertAudits inserts the current state of changed audits; the audits
+// engine keeps the last inserted row per id.
+func upsertAudits(ctx context.Context, ids []string, _ time.Time) error {
+	audits, err := AuditsMigration.fetch(ctx, ids)
+	if err != nil || len(audits) == 0 {
+		return err
+	}
+	_, err = AuditsMigration.write(ctx, audits)
+	return err
+}
+
+// removeAudits deletes audits with a mutation. Audits are not versioned,
+// and deleting them is rare enough for a mutation per transaction.
+func removeAudits(ctx context.Context, ids []string, _ time.Time) error {
+	return ch.WithContext(ctx).Exec("alter table audits delete where id in ?", ids).Error
+}
+
+// syncTx collects the ids changed by the transaction being decoded.
+type syncTx struct {
+	upserts map[string]map[string]struct{}
+	deletes map[string]map[string]struct{}
+}
+
+func newSyncTx() *syncTx {
+	return &syncTx{
+		upserts: map[string]map[string]struct{}{},
+		deletes: map[string]map[string]struct{}{},
+	}
+}
+
+func (tx *syncTx) add(table, id string, deleted bool) {
+	set, other := tx.upserts, tx.deletes
+	if deleted {
+		set, other = tx.deletes, tx.upserts
+	}
+
+	if set[table] == nil {
+		set[table] = map[string]struct{}{}
+	}
+	set[table][id] = struct{}{}
+	delete(other[table], id)
+}
+
+type syncer struct {
+	cp        *Checkpoint
+	applied   pglogrepl.LSN
+	relations map[uint32]*pglogrepl.RelationMessage
+	tx        *syncTx
+}
+
+// Sync consumes the sync.slot logical replication slot through pgoutput
+// and applies changes of workspace.jobs and workspace.audit to ClickHouse
+// transaction by transaction. The end LSN of the last applied transaction
+// is saved as a checkpoint and acknowledged to Postgres, so a restart
+// continues where the previous run stopped. It runs until ctx is cancelled
+// and then returns ctx.Err() after applying the transaction in progress.
+func Sync(ctx context.Context) error {
+	cfg := config.Config
+
+	if err := ensurePublication(ctx); err != nil {
+		return fmt.Errorf("Sync publication error: %s", err.Error())
+	}
+
+	conn, err := pgconn.Connect(ctx, fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=require replication=database",
+		cfg.Database.IP, cfg.Database.Port, cfg.Database.User, cfg.Database.Password, cfg.Database.Name))
+	if err != nil {
+		return fmt.Errorf("Replication connection error: %s", err.Error())
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if err := ensureSlot(ctx, conn); err != nil {
+		return fmt.Errorf("Sync slot error: %s", err.Error())
+	}
+
+	s, err := newSyncer(cfg.Sync.Slot)
+	if err != nil {
+		return err
+	}
+
+	err = pglogrepl.StartReplication(ctx, conn, cfg.Sync.Slot, s.applied, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"proto_version '1'", fmt.Sprintf("publication_names '%s'", cfg.Sync.Publication)},
+	})
+	if err != nil {
+		return fmt.Errorf("Start replication failed: %s", err.Error())
+	}
+	slog.Info("Sync started", "slot", cfg.Sync.Slot, "lsn", s.applied.String())
+
+	var (
+		interval = time.Duration(cfg.Sync.StatusInterval) * time.Second
+		deadline = time.Now().Add(interval)
+	)
+	for {
+		if !time.Now().Before(deadline) {
+			err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: s.applied})
+			if err != nil {
+				return fmt.Errorf("Sync status update failed: %s", err.Error())
+			}
+			deadline = time.Now().Add(interval)
+		}
+
+		rctx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := conn.ReceiveMessage(rctx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				pglogrepl.SendStandbyStatusUpdate(context.WithoutCancel(ctx), conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: s.applied})
+				slog.Info("Sync stopped", "lsn", s.applied.String())
+				return ctx.Err()
+			}
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return fmt.Errorf("Sync receive failed: %s", err.Error())
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("Sync failed: %s", msg.Message)
+		case *pgproto3.CopyData:
+			switch msg.Data[0] {
+			case pglogrepl.PrimaryKeepaliveMessageByteID:
+				pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+				if err != nil {
+					return fmt.Errorf("Sync keepalive invalid: %s", err.Error())
+				}
+				if pkm.ReplyRequested {
+					deadline = time.Time{}
+				}
+			case pglogrepl.XLogDataByteID:
+				xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+				if err != nil {
+					return fmt.Errorf("Sync xlog data invalid: %s", err.Error())
+				}
+				if err := s.handle(ctx, xld.WALData); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func ensurePublication(ctx context.Context) error {
+	cfg := config.Config.Sync
+
+	var n int64
+	err := db.Db.QueryRowContext(ctx, "select count(*) from pg_publication where pubname = $1", cfg.Publication).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	var tables []string
+	for t := range syncTables {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+
+	_, err = db.Db.ExecContext(ctx, fmt.Sprintf("create publication %s for table %s", pq.QuoteIdentifier(cfg.Publication), strings.Join(tables, ", ")))
+	return err
+}
+
+func ensureSlot(ctx context.Context, conn *pgconn.PgConn) error {
+	slot := config.Config.Sync.Slot
+
+	var n int64
+	err := db.Db.QueryRowContext(ctx, "select count(*) from pg_replication_slots where slot_name = $1", slot).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	_, err = pglogrepl.CreateReplicationSlot(ctx, conn, slot, "pgoutput", pglogrepl.CreateReplicationSlotOptions{})
+	if err == nil {
+		slog.Warn("Created replication slot; run a migration now to copy rows written before it", "slot", slot)
+	}
+	return err
+}
+
+// newSyncer returns a syncer for slot starting at the LSN its checkpoint
+// holds, or at the slot's confirmed position when it has none.
+func newSyncer(slot string) (*syncer, error) {
+	s := &syncer{
+		cp:        &Checkpoint{RunID: runID, Table: syncCheckpoint, Range: slot},
+		relations: map[uint32]*pglogrepl.RelationMessage{},
+	}
+
+	cps, err := checkpoints.Load(syncCheckpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Load sync checkpoint failed: %s", err.Error())
+	}
+	for _, cp := range cps {
+		if cp.Range == slot {
+			s.cp = cp
+			if s.applied, err = pglogrepl.ParseLSN(cp.LastKey); err != nil {
+				return nil, fmt.Errorf("Invalid sync checkpoint %q: %s", cp.LastKey, err.Error())
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *syncer) handle(ctx context.Context, data []byte) error {
+	msg, err := pglogrepl.Parse(data)
+	if err != nil {
+		return fmt.Errorf("Sync message invalid: %s", err.Error())
+	}
+
+	switch m := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		s.relations[m.RelationID] = m
+	case *pglogrepl.BeginMessage:
+		s.tx = newSyncTx()
+	case *pglogrepl.InsertMessage:
+		return s.change(m.RelationID, m.Tuple, false)
+	case *pglogrepl.UpdateMessage:
+		return s.change(m.RelationID, m.NewTuple, false)
+	case *pglogrepl.DeleteMessage:
+		return s.change(m.RelationID, m.OldTuple, true)
+	case *pglogrepl.TruncateMessage:
+		slog.Warn("Sync ignores truncate", "relations", m.RelationNum)
+	case *pglogrepl.CommitMessage:
+		return s.commit(context.WithoutCancel(ctx), m.TransactionEndLSN, m.CommitTime)
+	}
+	return nil
+}
+
+func (s *syncer) change(relation uint32, tuple *pglogrepl.TupleData, deleted bool) error {
+	rel, ok := s.relations[relation]
+	if !ok {
+		return fmt.Errorf("Sync got a change of unknown relation %d", relation)
+	}
+
+	table := rel.Namespace + "." + rel.RelationName
+	if syncTables[table] == nil || tuple == nil {
+		return nil
+	}
+
+	for i, c := range rel.Columns {
+		if c.Name == "id" && i < len(tuple.Columns) {
+			s.tx.add(table, string(tuple.Columns[i].Data), deleted)
+			return nil
+		}
+	}
+	return fmt.Errorf("Sync got a change of %s without its id", table)
+}
+
+// commit applies the changes of the transaction ending at lsn, committed
+// at at. ctx is not cancelled on shutdown, so a transaction is applied and
+// checkpointed entirely or not at all.
+func (s *syncer) commit(ctx context.Context, lsn pglogrepl.LSN, at time.Time) error {
+	var changed int
+	for table, t := range syncTables {
+		for _, step := range []struct {
+			ids   map[string]struct{}
+			apply func(ctx context.Context, ids []string, at time.Time) error
+		}{
+			{s.tx.upserts[table], t.upsert},
+			{s.tx.deletes[table], t.remove},
+		} {
+			apply := func(ctx context.Context, ids []string) error { return step.apply(ctx, ids, at) }
+			if err := applyChunked(ctx, step.ids, apply); err != nil {
+				return fmt.Errorf("Sync %s failed: %s", table, err.Error())
+			}
+			changed += len(step.ids)
+		}
+	}
+	s.tx = nil
+
+	s.applied = lsn
+	if changed == 0 {
+		return nil
+	}
+
+	s.cp.LastKey = lsn.String()
+	s.cp.Rows += int64(changed)
+	if err := saveCheckpoint(s.cp); err != nil {
+		return err
+	}
+	slog.Info("Sync applied changes", "rows", changed, "lsn", lsn.String())
+	return nil
+}
+
+// applyChunked calls apply with at most migration.batchsize ids at a time.
+func applyChunked(ctx context.Context, set map[string]struct{}, apply func(ctx context.Context, ids []string) error) error {
+	size := config.Config.Migration.BatchSize
+
+	ids := make([]string, 0, size)
+	for id := range set {
+		ids = append(ids, id)
+		if len(ids) == size {
+			if err := apply(ctx, ids); err != nil {
+				return err
+			}
+			ids = ids[:0]
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return apply(ctx, ids)
+}
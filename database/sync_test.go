@@ -0,0 +1,360 @@
+package database
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+
+	"clickhouse-migrations/config"
+)
+
+func TestSyncTxAdd(t *testing.T) {
+	type change struct {
+		table, id string
+		deleted   bool
+	}
+	tests := []struct {
+		name             string
+		changes          []change
+		upserts, deletes map[string][]string
+	}{
+		{
+			name:    "inserts and updates",
+			changes: []change{{"workspace.jobs", "a", false}, {"workspace.jobs", "a", false}, {"workspace.audit", "b", false}},
+			upserts: map[string][]string{"workspace.jobs": {"a"}, "workspace.audit": {"b"}},
+			deletes: map[string][]string{},
+		},
+		{
+			name:    "deleted after an update",
+			changes: []change{{"workspace.jobs", "a", false}, {"workspace.jobs", "b", false}, {"workspace.jobs", "a", true}},
+			upserts: map[string][]string{"workspace.jobs": {"b"}},
+			deletes: map[string][]string{"workspace.jobs": {"a"}},
+		},
+		{
+			name:    "inserted again after a delete",
+			changes: []change{{"workspace.jobs", "a", true}, {"workspace.jobs", "a", false}},
+			upserts: map[string][]string{"workspace.jobs": {"a"}},
+			deletes: map[string][]string{"workspace.jobs": {}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := newSyncTx()
+			for _, c := range tt.changes {
+				tx.add(c.table, c.id, c.deleted)
+			}
+			if got := idSets(tx.upserts); !reflect.DeepEqual(got, tt.upserts) {
+				t.Errorf("upserts = %v, want %v", got, tt.upserts)
+			}
+			if got := idSets(tx.deletes); !reflect.DeepEqual(got, tt.deletes) {
+				t.Errorf("deletes = %v, want %v", got, tt.deletes)
+			}
+		})
+	}
+}
+
+func idSets(sets map[string]map[string]struct{}) map[string][]string {
+	out := map[string][]string{}
+	for table, set := range sets {
+		out[table] = sortedIDs(set)
+	}
+	return out
+}
+
+func sortedIDs(set map[string]struct{}) []string {
+	ids := []string{}
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// syncCall is one call of a syncTable function recorded by useSyncTables.
+type syncCall struct {
+	table string
+	ids   []string
+	at    time.Time
+}
+
+// useSyncTables replaces the replicated tables with workspace.jobs and
+// workspace.audit recording their upserts and removes, for the duration of
+// the test.
+func useSyncTables(t *testing.T) (upserts, removes *[]syncCall) {
+	saved := syncTables
+	t.Cleanup(func() { syncTables = saved })
+
+	var mu sync.Mutex
+	upserts, removes = &[]syncCall{}, &[]syncCall{}
+	record := func(calls *[]syncCall, table string) func(ctx context.Context, ids []string, at time.Time) error {
+		return func(ctx context.Context, ids []string, at time.Time) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ids = append([]string(nil), ids...)
+			sort.Strings(ids)
+			*calls = append(*calls, syncCall{table, ids, at.UTC()})
+			return nil
+		}
+	}
+	syncTables = map[string]*syncTable{}
+	for _, table := range []string{"workspace.jobs", "workspace.audit"} {
+		syncTables[table] = &syncTable{upsert: record(upserts, table), remove: record(removes, table)}
+	}
+	return upserts, removes
+}
+
+func TestSyncerHandle(t *testing.T) {
+	useTestEnv(t, &fakeSource{})
+	upserts, removes := useSyncTables(t)
+
+	s, err := newSyncer("slot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.applied != 0 {
+		t.Fatalf("new syncer starts at %s, want the slot's position", s.applied)
+	}
+
+	var (
+		committed = time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+		first     = pglogrepl.LSN(0x16B374D848)
+		second    = first + 0x100
+	)
+	for _, msg := range [][]byte{
+		relationMsg(1, "workspace", "jobs", "run_at", "id"),
+		relationMsg(2, "workspace", "audit", "id"),
+		relationMsg(3, "workspace", "robots", "id"),
+		beginMsg(first, committed),
+		insertMsg(1, "2023-05-01", "a"),
+		updateMsg(1, "2023-05-01", "b"),
+		insertMsg(1, "2023-05-01", "c"),
+		deleteMsg(1, "", "c"),
+		insertMsg(2, "d"),
+		// tables that are not replicated are skipped
+		insertMsg(3, "e"),
+		commitMsg(first, committed),
+	} {
+		if err := s.handle(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantUpserts := []syncCall{{"workspace.audit", []string{"d"}, committed}, {"workspace.jobs", []string{"a", "b"}, committed}}
+	sort.Slice(*upserts, func(i, j int) bool { return (*upserts)[i].table < (*upserts)[j].table })
+	if !reflect.DeepEqual(*upserts, wantUpserts) {
+		t.Errorf("upserts = %v, want %v", *upserts, wantUpserts)
+	}
+	if want := []syncCall{{"workspace.jobs", []string{"c"}, committed}}; !reflect.DeepEqual(*removes, want) {
+		t.Errorf("removes = %v, want %v", *removes, want)
+	}
+	if s.applied != first {
+		t.Errorf("applied %s, want %s", s.applied, first)
+	}
+
+	// a transaction without replicated changes moves the position on but
+	// is not worth a checkpoint
+	for _, msg := range [][]byte{beginMsg(second, committed), insertMsg(3, "f"), commitMsg(second, committed)} {
+		if err := s.handle(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.applied != second {
+		t.Errorf("applied %s, want %s", s.applied, second)
+	}
+
+	cps, err := checkpoints.Load(syncCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cps) != 1 || cps[0].Range != "slot" || cps[0].LastKey != first.String() || cps[0].Rows != 4 {
+		t.Fatalf("checkpoints = %+v, want slot at %s with 4 rows", cps, first)
+	}
+
+	// a restart continues after the last checkpointed transaction
+	restarted, err := newSyncer("slot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.applied != first || restarted.cp.Rows != 4 {
+		t.Errorf("restarted at %s with %d rows, want %s with 4", restarted.applied, restarted.cp.Rows, first)
+	}
+	other, err := newSyncer("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.applied != 0 {
+		t.Errorf("other slot starts at %s, want its own position", other.applied)
+	}
+}
+
+func TestSyncerInvalidChanges(t *testing.T) {
+	useTestEnv(t, &fakeSource{})
+	useSyncTables(t)
+
+	tests := []struct {
+		name string
+		msgs [][]byte
+		err  string
+	}{
+		{
+			name: "unknown relation",
+			msgs: [][]byte{beginMsg(1, time.Now()), insertMsg(1, "a")},
+			err:  "unknown relation 1",
+		},
+		{
+			name: "no id column",
+			msgs: [][]byte{relationMsg(1, "workspace", "jobs", "run_at"), beginMsg(1, time.Now()), insertMsg(1, "2023-05-01")},
+			err:  "workspace.jobs without its id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSyncer("slot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range tt.msgs {
+				err = s.handle(context.Background(), msg)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("handle() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSyncerInvalidCheckpoint(t *testing.T) {
+	useTestEnv(t, &fakeSource{})
+	if err := saveCheckpoint(&Checkpoint{RunID: "earlier", Table: syncCheckpoint, Range: "slot", LastKey: "nope"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSyncer("slot"); err == nil || !strings.Contains(err.Error(), "Invalid sync checkpoint") {
+		t.Errorf("newSyncer() = %v, want the checkpoint rejected", err)
+	}
+}
+
+func TestApplyChunked(t *testing.T) {
+	config.Config = config.Default
+	defer func(size int) { config.Config.Migration.BatchSize = size }(config.Config.Migration.BatchSize)
+	config.Config.Migration.BatchSize = 2
+
+	set := map[string]struct{}{"a": {}, "b": {}, "c": {}, "d": {}, "e": {}}
+	var (
+		sizes []int
+		got   []string
+	)
+	err := applyChunked(context.Background(), set, func(ctx context.Context, ids []string) error {
+		sizes = append(sizes, len(ids))
+		got = append(got, ids...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(sizes, []int{2, 2, 1}) || !reflect.DeepEqual(got, sortedIDs(set)) {
+		t.Errorf("applied %v in chunks of %v, want every id in chunks of 2, 2, 1", got, sizes)
+	}
+}
+
+func TestJobVersions(t *testing.T) {
+	runAt := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		prev   time.Time
+		now    time.Time
+		want   time.Time
+		delete bool
+	}{
+		{name: "later change", prev: runAt, now: runAt.Add(time.Hour), want: runAt.Add(time.Hour)},
+		{name: "same millisecond", prev: runAt, now: runAt.Add(time.Microsecond), want: runAt.Add(time.Millisecond)},
+		{name: "earlier change", prev: runAt, now: runAt.Add(-time.Hour), want: runAt.Add(time.Millisecond)},
+		{name: "delete", prev: runAt, now: runAt.Add(time.Hour), want: runAt.Add(time.Hour), delete: true},
+		{name: "delete in the same millisecond", prev: runAt, now: runAt, want: runAt.Add(time.Millisecond), delete: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &Job{UpdatedAt: tt.prev}
+			if tt.delete {
+				j.markDeleted(tt.now)
+				if !j.IsDeleted || j.DeletedAt == nil || !j.DeletedAt.Equal(tt.now) {
+					t.Errorf("deleted %v at %v, want deleted at %v", j.IsDeleted, j.DeletedAt, tt.now)
+				}
+			} else {
+				j.touch(tt.now)
+			}
+			if !j.UpdatedAt.Equal(tt.want) {
+				t.Errorf("updated_at = %v, want %v", j.UpdatedAt, tt.want)
+			}
+		})
+	}
+}
+
+// relationMsg, beginMsg, commitMsg, insertMsg, updateMsg and deleteMsg
+// encode pgoutput protocol version 1 messages with text columns.
+func relationMsg(id uint32, namespace, name string, columns ...string) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{'R'}, id)
+	b = append(append(b, namespace...), 0)
+	b = append(append(b, name...), 0)
+	b = binary.BigEndian.AppendUint16(append(b, 'd'), uint16(len(columns)))
+	for _, c := range columns {
+		b = append(append(append(b, 0), c...), 0)
+		b = binary.BigEndian.AppendUint32(b, 25) // text
+		b = binary.BigEndian.AppendUint32(b, 0xffffffff)
+	}
+	return b
+}
+
+func beginMsg(lsn pglogrepl.LSN, at time.Time) []byte {
+	b := binary.BigEndian.AppendUint64([]byte{'B'}, uint64(lsn))
+	b = binary.BigEndian.AppendUint64(b, uint64(pgTime(at)))
+	return binary.BigEndian.AppendUint32(b, 1)
+}
+
+func commitMsg(lsn pglogrepl.LSN, at time.Time) []byte {
+	b := binary.BigEndian.AppendUint64([]byte{'C', 0}, uint64(lsn-8))
+	b = binary.BigEndian.AppendUint64(b, uint64(lsn))
+	return binary.BigEndian.AppendUint64(b, uint64(pgTime(at)))
+}
+
+func insertMsg(relation uint32, values ...string) []byte {
+	return tupleMsg(binary.BigEndian.AppendUint32([]byte{'I'}, relation), 'N', values)
+}
+
+func updateMsg(relation uint32, values ...string) []byte {
+	return tupleMsg(binary.BigEndian.AppendUint32([]byte{'U'}, relation), 'N', values)
+}
+
+// deleteMsg sends the replica identity, the id, with the other columns
+// null where values has them empty.
+func deleteMsg(relation uint32, values ...string) []byte {
+	return tupleMsg(binary.BigEndian.AppendUint32([]byte{'D'}, relation), 'K', values)
+}
+
+func tupleMsg(b []byte, kind byte, values []string) []byte {
+	b = binary.BigEndian.AppendUint16(append(b, kind), uint16(len(values)))
+	for _, v := range values {
+		if v == "" {
+			b = append(b, 'n')
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(append(b, 't'), uint32(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// pgTime returns t in microseconds since 2000-01-01, as pgoutput sends it.
+func pgTime(t time.Time) int64 {
+	return t.Sub(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).Microseconds()
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"clickhouse-migrations/config"
+)
+
+const tracerName = "clickhouse-migrations"
+
+var (
+	tracer   = otel.Tracer(tracerName)
+	provider *sdktrace.TracerProvider
+)
+
+// InitTracing installs the tracer provider exporting spans as set by
+// trace.exporter. With none, spans are not recorded at all.
+func InitTracing(ctx context.Context) error {
+	var (
+		cfg      = config.Config.Trace
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+
+	switch cfg.Exporter {
+	case "none":
+		return nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "file":
+		var f *os.File
+		f, err = os.OpenFile(cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			break
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return fmt.Errorf("unknown trace exporter %q, expected none, otlp or file", cfg.Exporter)
+	}
+	if err != nil {
+		return fmt.Errorf("Init tracing failed: %s", err.Error())
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(tracerName),
+		attribute.String("run.id", runID),
+	))
+	if err != nil {
+		return fmt.Errorf("Init tracing failed: %s", err.Error())
+	}
+
+	provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+// StartRun starts the span every other span of this run belongs to.
+func StartRun(ctx context.Context, command []string) context.Context {
+	ctx, _ = tracer.Start(ctx, "run "+strings.Join(command, " "),
+		trace.WithAttributes(
+			attribute.String("run.id", runID),
+			attribute.StringSlice("run.command", command),
+		))
+	return ctx
+}
+
+// EndRun ends the run span of ctx with err and flushes pending spans.
+func EndRun(ctx context.Context, err error) {
+	endSpan(trace.SpanFromContext(ctx), err)
+	if provider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		slog.Error("Flush spans failed", "error", err)
+	}
+}
+
+// startTable starts the span of op, e.g. migrate, on table.
+func startTable(ctx context.Context, op, table, destination string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, op+" "+table, trace.WithAttributes(
+		attribute.String("table", table),
+		attribute.String("destination", destination),
+	))
+}
+
+// endSpan records err, unless it is a cancellation, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// rangeAttributes describe the key range r of table.
+func rangeAttributes(table string, r *keyRange) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("table", table),
+		attribute.String("range", r.Name),
+	}
+	if !r.From.IsZero() {
+		attrs = append(attrs, attribute.String("range.from", r.From.Format(time.RFC3339)))
+	}
+	if !r.To.IsZero() {
+		attrs = append(attrs, attribute.String("range.to", r.To.Format(time.RFC3339)))
+	}
+	return attrs
+}
+
+// keyAttributes describe the keyset range after..last of a batch or page.
+func keyAttributes(after, last Key) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("key.after", after.String()),
+		attribute.String("key.last", last.String()),
+	}
+}
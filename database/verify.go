@@ -0,0 +1,180 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Verification selects per partition row counts and content hashes from
+// both sides of a migration. Both queries return the columns day (days
+// since the Unix epoch), workspace_id, row_count and hash, where hash is
+// the sum of 64-bit row hashes modulo 2^64 as text. The sum does not depend
+// on row order, so the two databases can compute it independently. Each
+// query has a %s verb in its where clause taking the filter as an "and"
+// condition, or nothing.
+type Verification struct {
+	Source      string
+	Destination string
+}
+
+// PartitionDiff is a (day, workspace) partition whose rows differ between
+// Postgres and ClickHouse. Day and WorkspaceID are empty when only whole
+// table counts are compared.
+type PartitionDiff struct {
+	Table       string `json:"table"`
+	Day         string `json:"day"`
+	WorkspaceID string `json:"workspace_id"`
+	SourceRows  int64  `json:"source_rows"`
+	DestRows    int64  `json:"destination_rows"`
+	SourceHash  string `json:"source_hash"`
+	DestHash    string `json:"destination_hash"`
+}
+
+// pgHash and chHash aggregate a per row text expression into the hash
+// column of a Verification query. Both take the first 8 bytes of the row's
+// MD5 as a big-endian integer and sum them modulo 2^64.
+func pgHash(row string) string {
+	return fmt.Sprintf(`mod(mod(sum(('x' || substr(md5(%s), 1, 16))::bit(64)::bigint), 18446744073709551616)
+		+ 18446744073709551616, 18446744073709551616)::text`, row)
+}
+
+func chHash(row string) string {
+	return fmt.Sprintf(`toString(sum(reinterpretAsUInt64(reverse(substring(MD5(%s), 1, 8)))))`, row)
+}
+
+type partitionRow struct {
+	Day         int64
+	WorkspaceID string
+	RowCount    int64
+	Hash        string
+}
+
+type partitionKey struct {
+	day         int64
+	workspaceID string
+}
+
+// Verify compares every registered migration and returns the partitions
+// that differ.
+func Verify(ctx context.Context) ([]*PartitionDiff, error) {
+	var diffs []*PartitionDiff
+	for _, m := range Migrators() {
+		d, err := m.Verify(ctx)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, d...)
+	}
+	return diffs, nil
+}
+
+// Verify compares per partition counts and hashes when d has a
+// Verification, and whole table counts otherwise, under the filter.
+func (d *Definition[S, D]) Verify(ctx context.Context) ([]*PartitionDiff, error) {
+	if d.Verification == nil {
+		s, err := d.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if s.Missing() == 0 {
+			return nil, nil
+		}
+		return []*PartitionDiff{{Table: d.Table, SourceRows: s.Source, DestRows: s.Destination}}, nil
+	}
+
+	srcCond, srcArgs, err := d.sourceFilter()
+	if err != nil {
+		return nil, err
+	}
+	dstCond, dstArgs, err := d.destFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := sourcePartitions(ctx, fmt.Sprintf(d.Verification.Source, and(srcCond)), srcArgs)
+	if err != nil {
+		return nil, fmt.Errorf("Verify %s in postgres failed: %s", d.Table, err.Error())
+	}
+
+	var dst []*partitionRow
+	if err := ch.WithContext(ctx).Raw(fmt.Sprintf(d.Verification.Destination, and(dstCond)), dstArgs...).Scan(&dst).Error; err != nil {
+		return nil, fmt.Errorf("Verify %s in clickhouse failed: %s", d.Table, err.Error())
+	}
+
+	return diffPartitions(d.Table, src, dst), nil
+}
+
+// and prefixes a non empty condition with "and" for a Verification query.
+func and(cond string) string {
+	if cond == "" {
+		return ""
+	}
+	return " and " + cond
+}
+
+func sourcePartitions(ctx context.Context, query string, args []interface{}) ([]*partitionRow, error) {
+	rows, err := db.Db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []*partitionRow
+	for rows.Next() {
+		p := &partitionRow{}
+		if err := rows.Scan(&p.Day, &p.WorkspaceID, &p.RowCount, &p.Hash); err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+func diffPartitions(table string, src, dst []*partitionRow) []*PartitionDiff {
+	var (
+		diffs = map[partitionKey]*PartitionDiff{}
+		keys  []partitionKey
+	)
+
+	get := func(p *partitionRow) *PartitionDiff {
+		k := partitionKey{p.Day, p.WorkspaceID}
+		if d, ok := diffs[k]; ok {
+			return d
+		}
+		d := &PartitionDiff{
+			Table:       table,
+			Day:         time.Unix(p.Day*86400, 0).UTC().Format("2006-01-02"),
+			WorkspaceID: p.WorkspaceID,
+		}
+		diffs[k] = d
+		keys = append(keys, k)
+		return d
+	}
+
+	for _, p := range src {
+		d := get(p)
+		d.SourceRows, d.SourceHash = p.RowCount, p.Hash
+	}
+	for _, p := range dst {
+		d := get(p)
+		d.DestRows, d.DestHash = p.RowCount, p.Hash
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].day != keys[j].day {
+			return keys[i].day < keys[j].day
+		}
+		return keys[i].workspaceID < keys[j].workspaceID
+	})
+
+	var mismatched []*PartitionDiff
+	for _, k := range keys {
+		d := diffs[k]
+		if d.SourceRows != d.DestRows || d.SourceHash != d.DestHash {
+			mismatched = append(mismatched, d)
+		}
+	}
+	return mismatched
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffPartitions(t *testing.T) {
+	const (
+		may1 = 19478 // 2023-05-01
+		may2 = 19479
+	)
+
+	tests := []struct {
+		name     string
+		src, dst []*partitionRow
+		want     []*PartitionDiff
+	}{
+		{
+			name: "equal",
+			src:  []*partitionRow{{Day: may1, WorkspaceID: "w1", RowCount: 2, Hash: "10"}},
+			dst:  []*partitionRow{{Day: may1, WorkspaceID: "w1", RowCount: 2, Hash: "10"}},
+		},
+		{
+			name: "missing rows",
+			src:  []*partitionRow{{Day: may1, WorkspaceID: "w1", RowCount: 2, Hash: "10"}},
+			dst:  []*partitionRow{{Day: may1, WorkspaceID: "w1", RowCount: 1, Hash: "4"}},
+			want: []*PartitionDiff{{Table: "jobs", Day: "2023-05-01", WorkspaceID: "w1",
+				SourceRows: 2, DestRows: 1, SourceHash: "10", DestHash: "4"}},
+		},
+		{
+			name: "same count, other content",
+			src:  []*partitionRow{{Day: may1, WorkspaceID: "w1", RowCount: 2, Hash: "10"}},
+			dst:  []*partitionRow{{Day: may1, WorkspaceID: "w1", RowCount: 2, Hash: "11"}},
+			want: []*PartitionDiff{{Table: "jobs", Day: "2023-05-01", WorkspaceID: "w1",
+				SourceRows: 2, DestRows: 2, SourceHash: "10", DestHash: "11"}},
+		},
+		{
+			name: "partitions on one side only, ordered by day and workspace",
+			src: []*partitionRow{
+				{Day: may2, WorkspaceID: "w1", RowCount: 1, Hash: "3"},
+				{Day: may1, WorkspaceID: "w2", RowCount: 1, Hash: "5"},
+			},
+			dst: []*partitionRow{{Day: may1, WorkspaceID: "w1", RowCount: 1, Hash: "7"}},
+			want: []*PartitionDiff{
+				{Table: "jobs", Day: "2023-05-01", WorkspaceID: "w1", DestRows: 1, DestHash: "7"},
+				{Table: "jobs", Day: "2023-05-01", WorkspaceID: "w2", SourceRows: 1, SourceHash: "5"},
+				{Table: "jobs", Day: "2023-05-02", WorkspaceID: "w1", SourceRows: 1, SourceHash: "3"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffPartitions("jobs", tt.src, tt.dst)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffPartitions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
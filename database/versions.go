@@ -0,0 +1,331 @@
+package database
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"clickhouse-migrations/config"
+)
+
+//go:embed migrations
+var embeddedMigrations embed.FS
+
+// SchemaMigration is one numbered .sql file of ClickHouse DDL.
+type SchemaMigration struct {
+	Version int64
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+type SchemaMigrationStatus struct {
+	*SchemaMigration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type appliedMigration struct {
+	Version   int64
+	IsApplied bool
+	AppliedAt time.Time
+}
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(.+)\.sql$`)
+
+// baselineVersion is the version of the migration generated from the
+// registered table schemas, which comes before every file.
+const baselineVersion = 0
+
+// baselineMigration returns the migration creating the registered
+// destination tables that do not exist yet, with the same statements
+// schema apply runs, so both create a table the same way. It has no down
+// statements: rolling it back keeps the tables and their data.
+func baselineMigration() *SchemaMigration {
+	m := &SchemaMigration{Version: baselineVersion, Name: "baseline"}
+	for _, s := range Schemas() {
+		m.Up = append(m.Up, s.CreateSQL())
+	}
+	return m
+}
+
+func migrationsFS() (fs.FS, error) {
+	if dir := config.Config.Schema.Dir; dir != "" {
+		return os.DirFS(dir), nil
+	}
+	return fs.Sub(embeddedMigrations, "migrations")
+}
+
+// LoadSchemaMigrations returns the baseline and the migrations read from
+// schema.dir, or the embedded ones, ordered by version.
+func LoadSchemaMigrations() ([]*SchemaMigration, error) {
+	fsys, err := migrationsFS()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		migrations = []*SchemaMigration{baselineMigration()}
+		seen       = map[int64]string{}
+	)
+	for _, file := range files {
+		match := migrationFileRe.FindStringSubmatch(path.Base(file))
+		if match == nil {
+			return nil, fmt.Errorf("Invalid schema migration file name %s, expected <version>_<name>.sql", file)
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schema migration version in %s: %s", file, err.Error())
+		}
+		if version == baselineVersion {
+			return nil, fmt.Errorf("Schema migration %s has version %d, which is the generated baseline's", file, baselineVersion)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("Schema migrations %s and %s have the same version", other, file)
+		}
+		seen[version] = file
+
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m := &SchemaMigration{Version: version, Name: match[2]}
+		if m.Up, m.Down, err = parseMigration(string(data)); err != nil {
+			return nil, fmt.Errorf("Invalid schema migration %s: %s", file, err.Error())
+		}
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// parseMigration splits a goose style file into up and down statements.
+func parseMigration(data string) (up, down []string, err error) {
+	var (
+		section *[]string
+		stmt    strings.Builder
+		block   bool
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if section == nil && strings.HasPrefix(trimmed, "-- +goose Statement") {
+			return nil, nil, fmt.Errorf("%s before -- +goose Up", trimmed)
+		}
+
+		switch trimmed {
+		case "-- +goose Up":
+			section = &up
+			continue
+		case "-- +goose Down":
+			section = &down
+			continue
+		case "-- +goose StatementBegin":
+			block = true
+			continue
+		case "-- +goose StatementEnd":
+			block = false
+			*section = append(*section, strings.TrimSpace(stmt.String()))
+			stmt.Reset()
+			continue
+		}
+
+		if section == nil {
+			if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+				return nil, nil, fmt.Errorf("statement before -- +goose Up")
+			}
+			continue
+		}
+		if !block && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+			continue
+		}
+
+		stmt.WriteString(line)
+		stmt.WriteString("\n")
+
+		if !block && strings.HasSuffix(trimmed, ";") {
+			*section = append(*section, strings.TrimSuffix(strings.TrimSpace(stmt.String()), ";"))
+			stmt.Reset()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if strings.TrimSpace(stmt.String()) != "" {
+		return nil, nil, fmt.Errorf("statement without a terminating semicolon")
+	}
+	if up == nil {
+		return nil, nil, fmt.Errorf("missing -- +goose Up section")
+	}
+	return up, down, nil
+}
+
+func schemaMigrationsTable() string {
+	return config.Config.Schema.Table
+}
+
+func initSchemaMigrations() error {
+	return ch.Exec(fmt.Sprintf(`create table if not exists %s (
+		version Int64,
+		name String,
+		is_applied Bool,
+		applied_at DateTime64(3)
+	) engine = MergeTree order by (version, applied_at)`, schemaMigrationsTable())).Error
+}
+
+// SchemaStatus returns every known migration with whether it is applied.
+func SchemaStatus() ([]*SchemaMigrationStatus, error) {
+	if err := initSchemaMigrations(); err != nil {
+		return nil, fmt.Errorf("Create %s failed: %s", schemaMigrationsTable(), err.Error())
+	}
+
+	migrations, err := LoadSchemaMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*appliedMigration
+	err = ch.Raw(fmt.Sprintf(`select version, argMax(is_applied, applied_at) as is_applied, max(applied_at) as applied_at
+		from %s group by version`, schemaMigrationsTable())).Scan(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("Read %s failed: %s", schemaMigrationsTable(), err.Error())
+	}
+
+	applied := map[int64]*appliedMigration{}
+	for _, e := range entries {
+		applied[e.Version] = e
+	}
+
+	statuses := make([]*SchemaMigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = &SchemaMigrationStatus{SchemaMigration: m}
+		if e := applied[m.Version]; e != nil && e.IsApplied {
+			statuses[i].Applied = true
+			statuses[i].AppliedAt = e.AppliedAt
+		}
+		delete(applied, m.Version)
+	}
+
+	for version, e := range applied {
+		if e.IsApplied {
+			return nil, fmt.Errorf("Schema migration %d is applied but its file is missing", version)
+		}
+	}
+	return statuses, nil
+}
+
+func runSchemaMigration(m *SchemaMigration, up bool) error {
+	stmts, direction := m.Up, "up"
+	if !up {
+		stmts, direction = m.Down, "down"
+	}
+
+	for _, stmt := range stmts {
+		if err := ch.Exec(stmt).Error; err != nil {
+			return fmt.Errorf("Schema migration %d_%s %s failed: %s", m.Version, m.Name, direction, err.Error())
+		}
+	}
+
+	err := ch.Exec(fmt.Sprintf(`insert into %s (version, name, is_applied, applied_at) values (?, ?, ?, ?)`, schemaMigrationsTable()),
+		m.Version, m.Name, up, time.Now()).Error
+	if err != nil {
+		return fmt.Errorf("Record schema migration %d_%s failed: %s", m.Version, m.Name, err.Error())
+	}
+
+	slog.Info("Schema migration done", "version", m.Version, "name", m.Name, "direction", direction)
+	return nil
+}
+
+// SchemaTo applies pending migrations up to version and rolls back applied
+// migrations above it. A negative version means the latest.
+func SchemaTo(version int64) error {
+	statuses, err := SchemaStatus()
+	if err != nil {
+		return err
+	}
+	if version < 0 && len(statuses) > 0 {
+		version = statuses[len(statuses)-1].Version
+	}
+
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if s := statuses[i]; s.Applied && s.Version > version {
+			if err := runSchemaMigration(s.SchemaMigration, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, s := range statuses {
+		if !s.Applied && s.Version <= version {
+			if err := runSchemaMigration(s.SchemaMigration, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SchemaUp applies every pending migration.
+func SchemaUp() error {
+	return SchemaTo(-1)
+}
+
+func lastApplied() (*SchemaMigrationStatus, error) {
+	statuses, err := SchemaStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if statuses[i].Applied {
+			return statuses[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No schema migration is applied")
+}
+
+// SchemaDown rolls back the latest applied migration.
+func SchemaDown() error {
+	s, err := lastApplied()
+	if err != nil {
+		return err
+	}
+	return runSchemaMigration(s.SchemaMigration, false)
+}
+
+// SchemaRedo rolls back and reapplies the latest applied migration.
+func SchemaRedo() error {
+	s, err := lastApplied()
+	if err != nil {
+		return err
+	}
+	if err := runSchemaMigration(s.SchemaMigration, false); err != nil {
+		return err
+	}
+	return runSchemaMigration(s.SchemaMigration, true)
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"clickhouse-migrations/config"
+)
+
+func TestParseMigration(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		up   []string
+		down []string
+		err  string
+	}{
+		{
+			name: "up and down",
+			data: `-- +goose Up
+alter table jobs add column if not exists trigger String;
+
+-- +goose Down
+alter table jobs drop column if exists trigger;
+`,
+			up:   []string{"alter table jobs add column if not exists trigger String"},
+			down: []string{"alter table jobs drop column if exists trigger"},
+		},
+		{
+			name: "header comments and multi line statements",
+			data: `-- adds triggers
+-- +goose Up
+alter table jobs
+	add column if not exists trigger String;
+-- a comment between statements
+alter table audits add column if not exists trigger String;
+`,
+			up: []string{
+				"alter table jobs\n\tadd column if not exists trigger String",
+				"alter table audits add column if not exists trigger String",
+			},
+		},
+		{
+			name: "statement block",
+			data: `-- +goose Up
+-- +goose StatementBegin
+alter table jobs modify comment 'a; b';
+-- +goose StatementEnd
+`,
+			up: []string{"alter table jobs modify comment 'a; b';"},
+		},
+		{
+			name: "missing up",
+			data: "-- +goose Down\nselect 1;\n",
+			err:  "missing -- +goose Up section",
+		},
+		{
+			name: "statement before up",
+			data: "select 1;\n-- +goose Up\nselect 2;\n",
+			err:  "statement before -- +goose Up",
+		},
+		{
+			name: "block before up",
+			data: "-- +goose StatementBegin\n-- +goose Up\n",
+			err:  "-- +goose StatementBegin before -- +goose Up",
+		},
+		{
+			name: "unterminated statement",
+			data: "-- +goose Up\nselect 1\n",
+			err:  "statement without a terminating semicolon",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, down, err := parseMigration(tt.data)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseMigration() error = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMigration() error = %v", err)
+			}
+			if !reflect.DeepEqual(up, tt.up) || !reflect.DeepEqual(down, tt.down) {
+				t.Errorf("parseMigration() = %q, %q, want %q, %q", up, down, tt.up, tt.down)
+			}
+		})
+	}
+}
+
+func TestLoadEmbeddedSchemaMigrations(t *testing.T) {
+	config.Config = config.Default
+
+	migrations, err := LoadSchemaMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Version != baselineVersion || migrations[0].Name != "baseline" {
+		t.Fatalf("LoadSchemaMigrations() = %v, want the baseline first", migrations)
+	}
+	var want []string
+	for _, s := range Schemas() {
+		want = append(want, s.CreateSQL())
+	}
+	if up := migrations[0].Up; !reflect.DeepEqual(up, want) {
+		t.Errorf("baseline up = %q, want the schemas' create statements %q", up, want)
+	}
+	if down := migrations[0].Down; len(down) != 0 {
+		t.Errorf("baseline down = %q, want none", down)
+	}
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			t.Errorf("migration %d comes after %d", migrations[i].Version, migrations[i-1].Version)
+		}
+	}
+}
+
+func TestLoadSchemaMigrationsReservedVersion(t *testing.T) {
+	config.Config = config.Default
+	defer func(dir string) { config.Config.Schema.Dir = dir }(config.Config.Schema.Dir)
+
+	config.Config.Schema.Dir = t.TempDir()
+	data := "-- +goose Up\nalter table jobs add column if not exists x String;\n"
+	if err := os.WriteFile(filepath.Join(config.Config.Schema.Dir, "00000_x.sql"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadSchemaMigrations()
+	if err == nil || !strings.Contains(err.Error(), "generated baseline") {
+		t.Errorf("LoadSchemaMigrations() = %v, want version 0 rejected", err)
+	}
+}
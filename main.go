@@ -3,34 +3,75 @@ package main
 import (
 	"clickhouse-migrations/config"
 	"clickhouse-migrations/database"
+	"context"
 	"flag"
 	"fmt"
-	"log"
-	"time"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
 )
 
-func initDatabase() {
-	for {
-		err := database.InitDB()
-		if err == nil {
-			log.Printf("Connected to database...")
-			break
-		}
-		log.Printf("Database connection error: %+v, waiting 5 sec...", err)
-		time.Sleep(time.Duration(5) * time.Second)
+// exitInterrupted is the status of a run stopped by SIGINT or SIGTERM after
+// checkpointing, as opposed to 1 for a failed run and 2 for bad usage.
+const exitInterrupted = 3
+
+func initDatabase(ctx context.Context) error {
+	if err := database.Retry(ctx, "Database connection", func() error { return database.InitDB(ctx) }); err != nil {
+		return err
+	}
+	slog.Info("Connected to database")
+
+	if err := database.Retry(ctx, "ClickHouse connection", func() error { return database.InitClickHouse(ctx) }); err != nil {
+		return fmt.Errorf("ClickHouse connection error: %s", err.Error())
 	}
+	slog.Info("Connected to ClickHouse")
+	return nil
+}
+
+// handleSignals cancels the returned context on the first SIGINT or SIGTERM,
+// letting in-flight batches finish and checkpoint. A second signal kills
+// the process right away.
+func handleSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
 
-	for {
-		err := database.InitClickHouse()
-		if err == nil {
-			log.Printf("Connected to ClickHouse...")
-			return
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		slog.Warn("Finishing in-flight batches; send the signal again to abort", "signal", sig.String())
+		cancel()
+	}()
+
+	return ctx
+}
+
+// exit writes the run report, if configured, records the outcome in the
+// ledger and flushes spans, then logs err and exits with exitInterrupted if
+// ctx was cancelled. With a nil err it just returns.
+func exit(ctx context.Context, err error) {
+	if path := config.Config.Progress.Report; path != "" {
+		if err := database.WriteReport(path, config.Config.Command, err, ctx.Err() != nil); err != nil {
+			slog.Error("Write run report failed", "error", err)
 		}
-		log.Printf("ClickHouse connection error: %+v, waiting 5 sec...", err)
-		time.Sleep(time.Duration(5) * time.Second)
 	}
+	if err := database.FinishLedgerRun(ctx, err, ctx.Err() != nil); err != nil {
+		slog.Error("Record run in ledger failed", "error", err)
+	}
+	database.EndRun(ctx, err)
+
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		slog.Warn("Interrupted", "error", err)
+		os.Exit(exitInterrupted)
+	}
+	slog.Error("Fatal", "error", err)
+	os.Exit(1)
 }
 
 func init() {
@@ -47,8 +88,80 @@ func main() {
 		return
 	}
 
-	initDatabase()
+	if err := database.InitLogger(); err != nil {
+		fmt.Printf("[FATAL] %s", err)
+		return
+	}
 
-	//database.MigrateJobs()
-	//database.MigrateAudits()
+	if err := database.LoadMappings(cfg.Migration.Mappings); err != nil {
+		fmt.Printf("[FATAL] %s", err)
+		return
+	}
+
+	if len(cfg.Command) == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	cmd := findCommand(cfg.Command[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", cfg.Command[0])
+		printUsage()
+		os.Exit(2)
+	}
+
+	if cfg.Migration.DryRun && cmd.name != "migrate" {
+		fmt.Fprintf(os.Stderr, "-dry-run is only supported by migrate\n")
+		os.Exit(2)
+	}
+
+	ctx := handleSignals()
+
+	if err := database.InitTracing(ctx); err != nil {
+		exit(ctx, err)
+	}
+	ctx = database.StartRun(ctx, cfg.Command)
+
+	if cfg.Metrics.Addr != "" {
+		database.ServeMetrics(cfg.Metrics.Addr)
+	}
+
+	if err := initDatabase(ctx); err != nil {
+		exit(ctx, err)
+	}
+
+	if err := database.InitFilter(); err != nil {
+		exit(ctx, err)
+	}
+
+	// a dry run only reads checkpoints, converts rows without rejecting
+	// those which fail, nor records anything in the ledger, so it issues
+	// no DDL
+	if cfg.Migration.DryRun {
+		if err := database.OpenCheckpoints(ctx); err != nil {
+			exit(ctx, err)
+		}
+	} else if cmd.state {
+		if err := database.InitCheckpoints(); err != nil {
+			exit(ctx, err)
+		}
+		if err := database.InitDeadLetters(); err != nil {
+			exit(ctx, err)
+		}
+		if cmd.ledger {
+			if err := database.InitLedger(ctx); err != nil {
+				exit(ctx, err)
+			}
+			if err := database.StartLedgerRun(ctx, cfg.Command); err != nil {
+				exit(ctx, err)
+			}
+		}
+	}
+
+	err = cmd.run(ctx, cfg.Command[1:])
+	if err == errUsage {
+		printUsage()
+		os.Exit(2)
+	}
+	exit(ctx, err)
 }